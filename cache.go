@@ -24,24 +24,101 @@ package cache
 
 import (
 	"errors"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Cache is a in-memory cache of values keyed by strings that supports expiry.
 type Cache struct {
-	durClean time.Duration
-	expirer  Expirer
+	// 64-bit atomically accessed fields must be first for alignment.
+	stats stats
+	owner uint64
 
-	mu      sync.Mutex
-	closed  bool
-	chClean chan struct{}
-	objs    map[string]value
+	backfillTTL        time.Duration
+	trackAccess        bool
+	codec              Codec
+	clock              Clock
+	coldLoader         LoaderFunc
+	copyBytes          bool
+	cpuBudget          float64
+	detectReentrancy   bool
+	duplicates         DuplicateKeyPolicy
+	durClean           time.Duration
+	jitter             float64
+	eviction           Eviction
+	expirableValues    bool
+	expirer            Expirer
+	lazyExpiry         bool
+	lazyExpiryFromRead bool
+	loader             LoaderFunc
+	loaderDefaultTTL   time.Duration
+	loaderZeroTTL      LoaderZeroTTLPolicy
+	logger             Logger
+	maxBytes           int64
+	maxCost            int64
+	maxSize            int
+	maxTTL             time.Duration
+	metrics            MetricsRecorder
+	minTTL             time.Duration
+	negativeTTL        time.Duration
+	migrate            MigrateFunc
+	onCleanCycle       func(CleanStats)
+	onEvict            OnEvictFunc
+	onExpire           func(key string, val interface{})
+	overwriteTTL       OverwriteTTLPolicy
+	piggyback          int
+	refreshLoader      LoaderFunc
+	sharedReads        bool
+	sizer              Sizer
+	sliding            bool
+	staleGrace         time.Duration
+	startingSize       int
+	valueHasher        ValueHasher
+	veto               VetoFunc
+	wallClock          bool
+
+	mu          sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	evicted     []eviction
+	expiring    int
+	metricsSize int
+	bytes       int64
+	cost        int64
+	cardinality *cardinalityGuard
+	chClean     chan struct{}
+	calls       map[string]*call
+	failed      map[string]failedLoad
+	inserted    map[string]time.Time
+	objs        map[string]value
+	populated   map[string]struct{}
+	vetoPending map[string]value
+	cycle       CleanStats
+	cycleWait   time.Duration
+	coalescer   *coalescer
+}
+
+// MigrateFunc transforms a value read from the cache, returning the new value
+// and whether it was changed. See WithReadMigration.
+type MigrateFunc func(val interface{}) (newVal interface{}, changed bool)
+
+// Expirable represents a value that knows its own expiry time. See the
+// WithExpirableValues option.
+type Expirable interface {
+	Expiry() time.Time
 }
 
 type value struct {
 	expireAt time.Time
+	staleAt  time.Time
+	ttl      time.Duration
+	size     int64
+	cost     int64
 	data     interface{}
+	reads    uint32
 }
 
 // New returns an initialized cache using any provided option.
@@ -51,78 +128,1091 @@ func New(ops ...Option) *Cache {
 		option.modify(&op)
 	}
 
-	var m map[string]value
-	if op.startingSize > 0 {
-		m = make(map[string]value, op.startingSize)
-	} else {
-		m = make(map[string]value)
+	c := &Cache{
+		backfillTTL:        op.chainBackfill,
+		trackAccess:        op.accessTracking,
+		codec:              op.codec,
+		clock:              op.clock,
+		coldLoader:         op.coldLoader,
+		copyBytes:          op.copyBytesOnGet,
+		cpuBudget:          op.cleanerCPUBudget,
+		detectReentrancy:   op.detectReentrancy,
+		duplicates:         op.duplicateKeys,
+		durClean:           op.cleanInterval,
+		jitter:             op.cleanJitter,
+		expirableValues:    op.expirableValues,
+		expirer:            op.expirer.clone(),
+		lazyExpiry:         op.lazyExpiry,
+		lazyExpiryFromRead: op.lazyExpiryFromRead,
+		loader:             op.loader,
+		loaderDefaultTTL:   op.loaderDefaultTTL,
+		loaderZeroTTL:      op.loaderZeroTTL,
+		logger:             op.logger,
+		maxBytes:           op.maxBytes,
+		maxCost:            op.maxCost,
+		maxSize:            op.maxSize,
+		maxTTL:             op.maxTTL,
+		metrics:            op.metrics,
+		minTTL:             op.minTTL,
+		negativeTTL:        op.negativeTTL,
+		migrate:            op.readMigration,
+		onCleanCycle:       op.cleanCycleHandler,
+		onEvict:            op.onEvict,
+		onExpire:           op.onExpire,
+		overwriteTTL:       op.overwriteTTL,
+		piggyback:          op.piggybackExpiry,
+		refreshLoader:      op.refreshLoader,
+		sizer:              op.sizer,
+		sliding:            op.slidingExpiry,
+		staleGrace:         op.staleGrace,
+		startingSize:       op.startingSize,
+		valueHasher:        op.valueHasher,
+		veto:               op.expiryVeto,
+		wallClock:          op.wallClockExpiry,
+		done:               make(chan struct{}),
+		objs:               newObjs(op.startingSize),
+	}
+	c.stats.cleanInterval = int64(c.durClean)
+	if op.eviction != nil {
+		c.eviction = op.eviction.clone()
+	}
+	// Reads can only share the mutex if they never modify the cache.
+	c.sharedReads = !c.detectReentrancy && !c.trackAccess && !c.sliding &&
+		c.eviction == nil && c.migrate == nil && c.piggyback == 0
+	if c.coldLoader != nil || c.refreshLoader != nil {
+		c.populated = make(map[string]struct{})
+	}
+	if op.insertionTracking {
+		c.inserted = make(map[string]time.Time)
+	}
+	if op.coalesceWindow > 0 {
+		c.coalescer = &coalescer{window: op.coalesceWindow}
+	}
+	if op.maxCardinality > 0 && op.cardinalityWindow > 0 {
+		c.cardinality = newCardinalityGuard(op.maxCardinality, op.cardinalityWindow)
 	}
-	return &Cache{
-		durClean: op.cleanInterval,
-		expirer:  op.expirer,
-		objs:     m,
+	if op.largeEntryFn != nil && op.largeEntryTopN > 0 && op.largeEntryInterval > 0 {
+		go c.largeEntryReporter(op.largeEntryTopN, op.largeEntryInterval, c.largestEntries, op.largeEntryFn)
 	}
+	if op.persistPath != "" {
+		if err := loadFile(op.persistPath, c.Load); err != nil {
+			c.logger.Printf("cache: loading snapshot from %s: %v", op.persistPath, err)
+		}
+		if op.persistInterval > 0 {
+			go c.persister(op.persistPath, op.persistInterval, c.Snapshot)
+		}
+	}
+	return c
+}
+
+func newObjs(size int) map[string]value {
+	if size > 0 {
+		return make(map[string]value, size)
+	}
+	return make(map[string]value)
 }
 
-// Get returns a value from the cache represented by the provided key.
+// Get returns a value from the cache represented by the provided key. If a
+// loader is configured, it is called for missing keys, and any loader error
+// results in nil being returned (see GetErr).
 func (c *Cache) Get(key string) interface{} {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	v, _ := c.GetOK(key)
+	return v
+}
+
+// GetOK returns a value from the cache represented by the provided key, and
+// true if it exists. If a loader is configured, it is called for missing keys,
+// and any loader error results in nil and false being returned (see GetErr).
+func (c *Cache) GetOK(key string) (interface{}, bool) {
+	if c.hasLoader() {
+		v, _ := c.GetErr(key)
+		return v, v != nil
+	}
+	v, ok, done := c.readShared(key)
+	if !done {
+		c.lock()
+		v, ok = c.lockedRead(c.now(), key)
+		c.unlock()
+	}
+	if !ok {
+		return nil, false
+	}
+	val := c.output(c.materialize(key, v.data))
+	return val, val != nil
+}
+
+// Has returns true if an unexpired value represented by the provided key
+// exists. It is read in the same way as Get, but without returning the value;
+// a loader isn't called for a missing key.
+func (c *Cache) Has(key string) bool {
+	_, ok, done := c.readShared(key)
+	if !done {
+		c.lock()
+		_, ok = c.lockedRead(c.now(), key)
+		c.unlock()
+	}
+	return ok
+}
+
+// readShared returns the unexpired value for the provided key while holding
+// the cache's mutex for reading, allowing concurrent reads. It returns false
+// for 'done' if the read must instead be made with the mutex held exclusively,
+// either because the value has expired and must be removed, or because reads
+// modify the cache (e.g. with WithSlidingExpiration).
+func (c *Cache) readShared(key string) (v value, ok, done bool) {
+	if !c.sharedReads {
+		return value{}, false, false
+	}
+	c.rlock()
+	v, ok = c.objs[key]
+	c.runlock()
+	if !ok {
+		c.recordMiss()
+		return value{}, false, true
+	}
+	if isExpired(c.now(), v) {
+		if !c.lazyExpiry {
+			c.recordMiss()
+			return value{}, false, true
+		}
+		return value{}, false, false
+	}
+	c.recordHit()
+	return v, true, true
+}
+
+// GetStale returns a value from the cache represented by the provided key, and
+// whether the value is stale. A value is stale once its soft expiry (see
+// SetExSoftHard) has passed.
+func (c *Cache) GetStale(key string) (interface{}, bool) {
+	c.lock()
+	now := c.now()
+	v, ok := c.lockedRead(now, key)
+	c.unlock()
+	if !ok {
+		return nil, false
+	}
+	return c.output(c.materialize(key, v.data)), isStale(now, v)
+}
+
+// Peek returns a value from the cache represented by the provided key, and true
+// if it exists, without recording the read. Unlike Get, it doesn't mark the
+// value as recently used (see WithEviction), extend its expiry (see
+// WithSlidingExpiration), call a loader, or count towards the hits and misses
+// reported by Stats. Expired values are still removed (see WithLazyExpiry).
+func (c *Cache) Peek(key string) (interface{}, bool) {
+	c.lock()
+	v, ok := c.lockedGet(c.now(), key)
+	c.unlock()
+	if !ok {
+		return nil, false
+	}
+	val := c.output(c.materialize(key, v.data))
+	return val, val != nil
+}
+
+// GetConsistent returns the values represented by all of the provided keys,
+// read atomically with respect to any writes. If any of the keys are missing,
+// nil and false are returned.
+func (c *Cache) GetConsistent(keys []string) (map[string]interface{}, bool) {
+	c.lock()
+	now := c.now()
+	m := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		v, ok := c.lockedRead(now, key)
+		if !ok {
+			c.unlock()
+			return nil, false
+		}
+		m[key] = v.data
+	}
+	c.unlock()
+
+	for key, data := range m {
+		m[key] = c.output(c.materialize(key, data))
+	}
+	return m, true
+}
+
+// GetAndExtendMulti returns the values represented by the provided keys,
+// extending the expiry of each by 'extension'. Only unexpired keys are
+// extended and returned; missing keys are omitted from the result.
+func (c *Cache) GetAndExtendMulti(keys []string, extension time.Duration) map[string]interface{} {
+	c.lock()
+	now := c.now()
+	m := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		v, ok := c.lockedRead(now, key)
+		if !ok {
+			continue
+		}
+		if !v.expireAt.IsZero() {
+			v = c.withExpiry(now, v, v.expireAt.Add(extension))
+			c.lockedPut(key, v)
+		}
+		m[key] = v.data
+	}
+	c.unlock()
+
+	for key, data := range m {
+		m[key] = c.output(c.materialize(key, data))
+	}
+	return m
+}
+
+// lockedGet returns the unexpired value for the provided key, deleting it if
+// it has expired.
+func (c *Cache) lockedGet(now time.Time, key string) (value, bool) {
+	if c.piggyback > 0 {
+		c.lockedExpireSome(now, time.Time{}, c.piggyback)
+	}
 	v, ok := c.objs[key]
 	if !ok {
-		return nil
+		return value{}, false
 	}
-	if isExpired(time.Now(), v) {
-		delete(c.objs, key)
-		return nil
+	if isExpired(now, v) {
+		c.lockedRemoveExpired(key, v)
+		return value{}, false
 	}
-	return v.data
+	if data, ok := c.migrated(v.data); ok {
+		v.data = data
+		v = c.lockedResize(v)
+		c.objs[key] = v
+	}
+	return v, true
+}
+
+const maxReads = ^uint32(0)
+
+// lockedRemoveExpired removes the expired value for the provided key on
+// behalf of a caller reading it, unless lazy expiry is disabled (see
+// WithLazyExpiry).
+func (c *Cache) lockedRemoveExpired(key string, v value) {
+	if c.lazyExpiry {
+		c.lockedRemove(key, v, Expired)
+	}
+}
+
+// lockedRead returns the unexpired value for the provided key on behalf of a
+// caller reading it, recording the access if access tracking is enabled.
+func (c *Cache) lockedRead(now time.Time, key string) (value, bool) {
+	v, ok := c.lockedGet(now, key)
+	if !ok {
+		c.recordMiss()
+		return v, false
+	}
+	c.recordHit()
+	if c.trackAccess && v.reads < maxReads {
+		v.reads++
+		c.objs[key] = v
+	}
+	if c.sliding && !v.expireAt.IsZero() && v.ttl > 0 {
+		v.expireAt = now.Add(v.ttl)
+		c.objs[key] = v
+	}
+	c.lockedTouch(key)
+	return v, true
+}
+
+// migrated returns the result of applying the read migration to the provided
+// data, and whether it was changed. Lazy values are migrated once computed.
+func (c *Cache) migrated(data interface{}) (interface{}, bool) {
+	if c.migrate == nil {
+		return data, false
+	}
+	if _, ok := data.(*lazyValue); ok {
+		return data, false
+	}
+	// A panicking migration leaves the data unchanged, rather than leaving
+	// the cache locked.
+	var newData interface{}
+	var changed bool
+	c.protect("read migration", func() { newData, changed = c.migrate(data) })
+	if !changed || newData == nil {
+		return data, false
+	}
+	return newData, true
+}
+
+// output returns the data to provide to the caller.
+func (c *Cache) output(data interface{}) interface{} {
+	if c.copyBytes {
+		if b, ok := data.([]byte); ok {
+			cp := make([]byte, len(b))
+			copy(cp, b)
+			return cp
+		}
+	}
+	return data
 }
 
 // Len returns the current number of values in the cache.
 func (c *Cache) Len() int {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.rlock()
+	defer c.runlock()
 	return len(c.objs)
 }
 
+// Set sets the provided key and value without an expiry. The value remains in
+// the cache until it is overwritten or the cache is closed.
+func (c *Cache) Set(key string, val interface{}) {
+	if !c.acceptValue(val) {
+		return
+	}
+	c.lock()
+	defer c.unlock()
+	if c.lockedAcceptWrite() {
+		c.lockedSet(c.now(), key, value{data: val})
+	}
+}
+
 // SetEx sets the provided key and value, using 'exp' as the expiry duration.
 func (c *Cache) SetEx(key string, val interface{}, exp time.Duration) {
-	if val == nil || exp <= 0 {
+	if !c.acceptWrite(val, exp) {
 		return
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.closed {
+	if c.coalescer != nil {
+		c.coalescer.add(c, key, value{expireAt: c.now().Add(exp), data: val})
+		return
+	}
+	c.lock()
+	defer c.unlock()
+	if c.lockedAcceptWrite() {
+		now := c.now()
+		c.lockedSet(now, key, value{expireAt: now.Add(exp), data: val})
+	}
+}
+
+// TrySetEx sets the provided key and value, using 'exp' as the expiry duration,
+// returning true if the value was stored. It returns false if the write was
+// rejected (see Stats.RejectedWrites).
+// Unlike SetEx, the write is never coalesced (see WithWriteCoalescing); any
+// pending coalesced write for the key is discarded.
+func (c *Cache) TrySetEx(key string, val interface{}, exp time.Duration) bool {
+	if !c.acceptWrite(val, exp) {
+		return false
+	}
+	c.lock()
+	defer c.unlock()
+	if !c.lockedAcceptWrite() {
+		return false
+	}
+	now := c.now()
+	return c.lockedSet(now, key, value{expireAt: now.Add(exp), data: val})
+}
+
+// SetAt sets the provided key and value, expiring at 'expireAt'. If 'expireAt'
+// has already passed, the value is not set.
+func (c *Cache) SetAt(key string, val interface{}, expireAt time.Time) {
+	if !c.acceptWrite(val, expireAt.Sub(c.now())) {
+		return
+	}
+	c.lock()
+	defer c.unlock()
+	if c.lockedAcceptWrite() {
+		now := c.now()
+		if expireAt.After(now) {
+			c.lockedSet(now, key, value{expireAt: expireAt, data: val})
+		}
+	}
+}
+
+// ExpireAt sets the expiry of the value represented by the provided key to
+// 't', without modifying the value. If 't' has already passed, the value is
+// removed. It returns true if an unexpired value existed.
+func (c *Cache) ExpireAt(key string, t time.Time) bool {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	v, ok := c.lockedGet(now, key)
+	if !ok {
+		return false
+	}
+	if !t.After(now) {
+		c.lockedRemove(key, v, Expired)
+		return true
+	}
+	v = c.withExpiry(now, v, t)
+	c.lockedPut(key, v)
+	c.expirer.onSet(key, v)
+	c.lockedStartCleaner()
+	return true
+}
+
+// Persist removes the expiry of the value represented by the provided key, so
+// that it remains in the cache until it is overwritten or deleted. It returns
+// true if an unexpired value existed.
+func (c *Cache) Persist(key string) bool {
+	c.lock()
+	defer c.unlock()
+	v, ok := c.lockedGet(c.now(), key)
+	if !ok {
+		return false
+	}
+	v.expireAt = time.Time{}
+	v.ttl = 0
+	c.lockedPut(key, v)
+	c.expirer.onSet(key, v)
+	return true
+}
+
+// defaultCost is the cost of values set without an explicit cost.
+const defaultCost = 1
+
+// SetExCost sets the provided key and value, using 'exp' as the expiry duration
+// and 'cost' as its cost towards the limit on the total cost of values (see
+// WithMaxCost). A non-positive 'cost' is treated as a cost of 1, the cost of
+// values set using other methods.
+func (c *Cache) SetExCost(key string, val interface{}, exp time.Duration, cost int64) {
+	if !c.acceptWrite(val, exp) {
 		return
 	}
-	c.objs[key] = value{expireAt: time.Now().Add(exp), data: val}
+	c.lock()
+	defer c.unlock()
+	if c.lockedAcceptWrite() {
+		now := c.now()
+		c.lockedSet(now, key, value{expireAt: now.Add(exp), data: val, cost: cost})
+	}
+}
+
+// Cost returns the total cost of the values in the cache (see SetExCost).
+func (c *Cache) Cost() int64 {
+	c.rlock()
+	defer c.runlock()
+	return c.cost
+}
+
+// SetExSoftHard sets the provided key and value with both a soft and hard
+// expiry duration. Once 'soft' has elapsed, the value is considered stale (see
+// GetStale), but is still returned. Once 'hard' has elapsed, the value is
+// expired and removed.
+func (c *Cache) SetExSoftHard(key string, val interface{}, soft, hard time.Duration) {
+	if !c.acceptWrite(val, hard) {
+		return
+	}
+	c.lock()
+	defer c.unlock()
+	if c.lockedAcceptWrite() {
+		now := c.now()
+		v := value{expireAt: now.Add(hard), data: val}
+		if soft > 0 && soft < hard {
+			v.staleAt = now.Add(soft)
+		}
+		c.lockedSet(now, key, v)
+	}
+}
+
+// SetIfNewer sets the provided key and value, using 'exp' as the expiry
+// duration, only if no value exists for the key or if less(existing, val)
+// returns true. It returns true if the value was set.
+// Note: 'less' is called while the cache is locked, and must not call any
+// methods on the cache.
+func (c *Cache) SetIfNewer(key string, val interface{}, exp time.Duration, less func(existing, incoming interface{}) bool) bool {
+	if !c.acceptWrite(val, exp) {
+		return false
+	}
+	c.lock()
+	defer c.unlock()
+	if !c.lockedAcceptWrite() {
+		return false
+	}
+	now := c.now()
+	if v, ok := c.objs[key]; ok && !isExpired(now, v) && !less(resolve(v.data), val) {
+		return false
+	}
+	return c.lockedSet(now, key, value{expireAt: now.Add(exp), data: val})
+}
+
+// GetOrComputeSync returns the value represented by the provided key. If no
+// value exists, the result of calling 'fn' is set using 'exp' as the expiry
+// duration, and returned.
+// Note: 'fn' is called while the cache is locked, blocking all other
+// operations, so it must be fast and must not call any methods on the cache.
+func (c *Cache) GetOrComputeSync(key string, exp time.Duration, fn func() interface{}) interface{} {
+	val, _ := c.GetOrInit(key, exp, fn)
+	return val
+}
+
+// GetOrInit returns the value represented by the provided key. If no value
+// exists, the result of calling 'init' is set using 'exp' as the expiry
+// duration, and returned. 'created' is true if 'init' was called. If the cache
+// is closed, 'init' isn't called, and nil and false are returned.
+// Note: 'init' is called while the cache is locked, blocking all other
+// operations, so it must be fast and must not call any methods on the cache.
+func (c *Cache) GetOrInit(key string, exp time.Duration, init func() interface{}) (val interface{}, created bool) {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	if v, ok := c.lockedRead(now, key); ok {
+		return c.output(resolve(v.data)), false
+	}
+	if !c.lockedAcceptWrite() {
+		return nil, false
+	}
+	val = init()
+	if c.acceptWrite(val, exp) {
+		c.lockedSet(now, key, value{expireAt: now.Add(exp), data: val})
+	}
+	return c.output(val), true
+}
+
+// Update atomically replaces the value represented by the provided key with the
+// result of calling 'fn' with the current value, and whether it exists. If
+// 'fn' returns true, the new value is set using 'exp' as the expiry duration;
+// otherwise, the key is deleted. If 'exp' is non-positive, the expiry of an
+// existing value is kept, and a new value has no expiry.
+// Note: 'fn' is called while the cache is locked, blocking all other
+// operations, so it must be fast and must not call any methods on the cache.
+func (c *Cache) Update(key string, exp time.Duration, fn func(old interface{}, found bool) (interface{}, bool)) {
+	c.lock()
+	defer c.unlock()
+	if !c.lockedAcceptWrite() {
+		return
+	}
+	now := c.now()
+	v, found := c.lockedGet(now, key)
+	var old interface{}
+	if found {
+		old = c.output(resolve(v.data))
+	}
+	val, keep := fn(old, found)
+	if !keep {
+		if found {
+			c.lockedRemove(key, v, Deleted)
+		}
+		return
+	}
+	if !c.acceptValue(val) {
+		return
+	}
+	next := value{data: val}
+	if exp > 0 {
+		next.expireAt = now.Add(exp)
+	} else if found {
+		next.expireAt = v.expireAt
+		next.staleAt = v.staleAt
+	}
+	c.lockedSet(now, key, next)
+}
+
+// acceptWrite returns true if a value may be written with the provided expiry,
+// recording the reason for any rejection.
+func (c *Cache) acceptWrite(val interface{}, exp time.Duration) bool {
+	if !c.acceptValue(val) {
+		return false
+	}
+	if exp <= 0 {
+		atomic.AddUint64(&c.stats.rejectedTTL, 1)
+		return false
+	}
+	return true
+}
+
+// acceptValue returns true if the value may be written, recording a rejection
+// otherwise.
+func (c *Cache) acceptValue(val interface{}) bool {
+	if val == nil {
+		atomic.AddUint64(&c.stats.rejectedNil, 1)
+		return false
+	}
+	return true
+}
+
+// clampTTL returns the provided expiry duration limited by the cache's minimum
+// and maximum (see WithMinTTL and WithMaxTTL).
+func (c *Cache) clampTTL(exp time.Duration) time.Duration {
+	if c.minTTL > 0 && exp > 0 && exp < c.minTTL {
+		exp = c.minTTL
+	}
+	if c.maxTTL > 0 && exp > c.maxTTL {
+		return c.maxTTL
+	}
+	return exp
+}
+
+// withExpiry returns 'v' set to expire at 't', limited by clampTTL relative to
+// 'now', with its expiry duration updated to match. The zero time means no
+// expiry. All changes to the expiry of a value go through withExpiry, so that
+// the limits are always applied.
+func (c *Cache) withExpiry(now time.Time, v value, t time.Time) value {
+	if t.IsZero() {
+		v.expireAt, v.ttl = t, 0
+		return v
+	}
+	v.ttl = c.clampTTL(t.Sub(now))
+	v.expireAt = now.Add(v.ttl)
+	return v
+}
+
+// lockedAcceptWrite returns true if the cache is able to accept writes.
+func (c *Cache) lockedAcceptWrite() bool {
+	if c.closed {
+		atomic.AddUint64(&c.stats.rejectedClosed, 1)
+		return false
+	}
+	return true
+}
+
+// lockedSet stores the value for the provided key, discarding any buffered
+// write for the key (see WithWriteCoalescing). It returns false if the value
+// was rejected.
+func (c *Cache) lockedSet(now time.Time, key string, v value) bool {
+	c.lockedCancelPending(key)
+	return c.lockedStore(now, key, v)
+}
+
+// lockedStore stores the value for the provided key, starting the cleaner if it
+// isn't already running and the value has an expiry. It returns false if the
+// value was rejected.
+func (c *Cache) lockedStore(now time.Time, key string, v value) bool {
+	v.size = c.valueSize(v.data)
+	if c.maxBytes > 0 && v.size > c.maxBytes {
+		atomic.AddUint64(&c.stats.rejectedSize, 1)
+		return false
+	}
+	if v.cost <= 0 {
+		v.cost = defaultCost
+	}
+	if c.maxCost > 0 && v.cost > c.maxCost {
+		atomic.AddUint64(&c.stats.rejectedCost, 1)
+		return false
+	}
+	if c.cardinality != nil && !c.cardinality.admit(now, key) {
+		atomic.AddUint64(&c.stats.rejectedCardinality, 1)
+		return false
+	}
+	if c.maxSize > 0 {
+		if _, ok := c.objs[key]; !ok {
+			c.lockedMakeRoom(now)
+		}
+	}
+	if c.maxBytes > 0 {
+		c.lockedMakeRoomBytes(now, key, v.size)
+	}
+	if c.maxCost > 0 {
+		c.lockedMakeRoomCost(now, key, v.cost)
+	}
+	v = c.withExpiry(now, v, v.expireAt)
+	if c.staleGrace > 0 && !v.expireAt.IsZero() && c.hasLoader() {
+		// The value becomes stale at its expiry, and is kept for the grace
+		// period while it is refreshed.
+		if v.staleAt.IsZero() {
+			v.staleAt = v.expireAt
+		}
+		v.expireAt = v.expireAt.Add(c.staleGrace)
+	}
+	if c.expirableValues {
+		if e, ok := v.data.(Expirable); ok {
+			var t time.Time
+			c.protect("Expiry method", func() { t = e.Expiry() })
+			if !t.IsZero() && t.Before(v.expireAt) {
+				v.expireAt = t
+			}
+		}
+	}
+	old, exists := c.objs[key]
+	if exists && !isExpired(now, old) {
+		v.expireAt = c.overwriteExpiry(old.expireAt, v.expireAt)
+	}
+	if c.inserted != nil {
+		c.inserted[key] = now
+	}
+	if !v.expireAt.IsZero() {
+		v.ttl = v.expireAt.Sub(now)
+	}
+	c.lockedPut(key, v)
+	c.bytes += v.size - old.size
+	c.cost += v.cost - old.cost
+	if exists {
+		if isExpired(now, old) {
+			c.lockedNotify(key, old, Expired)
+		} else {
+			c.lockedNotify(key, old, Replaced)
+		}
+	}
+	c.lockedTouch(key)
+	if n := uint64(len(c.objs)); n > atomic.LoadUint64(&c.stats.peakSize) {
+		atomic.StoreUint64(&c.stats.peakSize, n)
+	}
+	if c.populated != nil {
+		c.populated[key] = struct{}{}
+	}
+	delete(c.failed, key)
+	c.expirer.onSet(key, v)
+	// Values without an expiry never need cleaning.
+	if !v.expireAt.IsZero() {
+		c.lockedStartCleaner()
+	}
+	return true
+}
+
+// lockedPut stores the value for the provided key, counting the values with an
+// expiry so that the cleaner can stop once there are none. Values whose expiry
+// hasn't changed may be stored directly.
+func (c *Cache) lockedPut(key string, v value) {
+	old, ok := c.objs[key]
+	wasExpiring := ok && !old.expireAt.IsZero()
+	if wasExpiring {
+		c.expiring--
+	}
+	c.objs[key] = v
+	if !v.expireAt.IsZero() {
+		c.expiring++
+	} else if wasExpiring && c.expiring == 0 {
+		c.lockedWakeCleaner()
+	}
+}
+
+// lockedStartCleaner starts the cleaner if it isn't already running.
+func (c *Cache) lockedStartCleaner() {
 	if c.chClean == nil {
 		c.chClean = make(chan struct{}, 1)
 		go c.cleaner()
 	}
 }
 
+// lockedWakeCleaner signals the cleaner, if it is running, to wake without
+// waiting for its next interval. It stops if there is nothing left to clean.
+func (c *Cache) lockedWakeCleaner() {
+	if c.chClean != nil {
+		select {
+		case c.chClean <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Touch sets the expiry of the value represented by the provided key to 'exp'
+// from now, without modifying the value. It returns true if an unexpired value
+// exists and was updated. A non-positive 'exp' is a no-op returning false.
+func (c *Cache) Touch(key string, exp time.Duration) bool {
+	if exp <= 0 {
+		return false
+	}
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return false
+	}
+	now := c.now()
+	v, ok := c.lockedGet(now, key)
+	if !ok {
+		return false
+	}
+	v = c.withExpiry(now, v, now.Add(exp))
+	c.lockedPut(key, v)
+	c.lockedTouch(key)
+	c.expirer.onSet(key, v)
+	c.lockedStartCleaner()
+	return true
+}
+
+// Delete removes the value represented by the provided key, returning true if
+// an unexpired value was removed.
+func (c *Cache) Delete(key string) bool {
+	c.lock()
+	defer c.unlock()
+	c.lockedCancelPending(key)
+	v, ok := c.lockedGet(c.now(), key)
+	if ok {
+		c.lockedRemove(key, v, Deleted)
+	}
+	return ok
+}
+
+// GetAndDelete atomically removes the value represented by the provided key,
+// returning it and true if it existed and was unexpired.
+func (c *Cache) GetAndDelete(key string) (interface{}, bool) {
+	c.lock()
+	c.lockedCancelPending(key)
+	v, ok := c.lockedRead(c.now(), key)
+	if ok {
+		c.lockedRemove(key, v, Deleted)
+	}
+	c.unlock()
+	if !ok {
+		return nil, false
+	}
+	val := c.output(resolve(v.data))
+	return val, val != nil
+}
+
+// DeleteIfTTLBelow removes the value represented by 'key' only if its
+// remaining "time-to-live" is less than 'threshold'. It returns true if the
+// value was removed.
+func (c *Cache) DeleteIfTTLBelow(key string, threshold time.Duration) bool {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	v, ok := c.lockedGet(now, key)
+	if !ok || v.expireAt.IsZero() || v.expireAt.Sub(now) >= threshold {
+		return false
+	}
+	c.lockedRemove(key, v, Deleted)
+	return true
+}
+
+// DeleteFunc removes every unexpired value for which 'fn' returns true,
+// returning the number of values removed. Any expired entries that are
+// encountered are deleted (see WithLazyExpiry).
+// Note: the cache is locked for the duration of the iteration, so 'fn' must
+// not call any methods on the cache.
+func (c *Cache) DeleteFunc(fn func(key string, val interface{}) bool) int {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	var n int
+	for k, v := range c.objs {
+		if isExpired(now, v) {
+			c.lockedRemoveExpired(k, v)
+			continue
+		}
+		val := c.output(resolve(v.data))
+		if val == nil || !fn(k, val) {
+			continue
+		}
+		c.lockedRemove(k, v, Deleted)
+		n++
+	}
+	return n
+}
+
+// DeletePrefix removes every unexpired value whose key starts with 'prefix',
+// returning the number of values removed. Any expired entries that are
+// encountered are deleted (see WithLazyExpiry).
+// Note: this is O(n) in the size of the cache.
+func (c *Cache) DeletePrefix(prefix string) int {
+	c.lock()
+	defer c.unlock()
+	if c.coalescer != nil {
+		c.coalescer.cancelPrefix(prefix)
+	}
+	now := c.now()
+	var n int
+	for k, v := range c.objs {
+		if isExpired(now, v) {
+			c.lockedRemoveExpired(k, v)
+			continue
+		}
+		if strings.HasPrefix(k, prefix) {
+			c.lockedRemove(k, v, Deleted)
+			n++
+		}
+	}
+	return n
+}
+
+// Swap atomically exchanges the values represented by 'keyA' and 'keyB',
+// along with their expiries. If only one of the keys exists, its value is
+// moved to the other key.
+func (c *Cache) Swap(keyA, keyB string) {
+	if keyA == keyB {
+		return
+	}
+	c.lock()
+	defer c.unlock()
+	c.lockedCancelPending(keyA)
+	c.lockedCancelPending(keyB)
+	now := c.now()
+	a, okA := c.lockedGet(now, keyA)
+	b, okB := c.lockedGet(now, keyB)
+	// Remove both values, along with any expired values that were kept (see
+	// WithLazyExpiry), before storing them under their new keys.
+	for _, key := range []string{keyA, keyB} {
+		if v, ok := c.objs[key]; ok {
+			if isExpired(now, v) {
+				c.lockedRemove(key, v, Expired)
+			} else {
+				c.lockedDelete(key)
+			}
+		}
+	}
+	put := func(key string, v value) {
+		c.lockedPut(key, v)
+		c.bytes += v.size
+		c.cost += v.cost
+		c.expirer.onSet(key, v)
+		c.lockedTouch(key)
+	}
+	if okA {
+		put(keyB, a)
+	}
+	if okB {
+		put(keyA, b)
+	}
+}
+
+// Clear removes all values from the cache. Unlike Close, the cache remains
+// usable afterwards.
+func (c *Cache) Clear() {
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return
+	}
+	if c.coalescer != nil {
+		c.coalescer.discard()
+	}
+	if c.onEvict != nil || c.metrics != nil {
+		for k, v := range c.objs {
+			c.lockedNotify(k, v, Cleared)
+		}
+	}
+	c.objs = newObjs(c.startingSize)
+	c.expiring = 0
+	c.expirer.reset()
+	c.bytes = 0
+	c.cost = 0
+	c.failed = nil
+	if c.eviction != nil {
+		c.eviction.reset()
+	}
+	if c.populated != nil {
+		c.populated = make(map[string]struct{})
+	}
+	if c.inserted != nil {
+		c.inserted = make(map[string]time.Time)
+	}
+	c.vetoPending = nil
+	c.lockedWakeCleaner()
+}
+
+// Rotate atomically removes all values from the cache, returning the values
+// that were not yet expired. The caller owns the returned values.
+func (c *Cache) Rotate() map[string]interface{} {
+	c.lock()
+	if c.closed {
+		c.unlock()
+		return nil
+	}
+	if c.coalescer != nil {
+		c.coalescer.discard()
+	}
+	old := c.objs
+	c.objs = newObjs(c.startingSize)
+	c.expiring = 0
+	c.expirer.reset()
+	c.bytes = 0
+	c.cost = 0
+	c.failed = nil
+	if c.eviction != nil {
+		c.eviction.reset()
+	}
+	if c.populated != nil {
+		c.populated = make(map[string]struct{})
+	}
+	if c.inserted != nil {
+		c.inserted = make(map[string]time.Time)
+	}
+	c.lockedWakeCleaner()
+
+	c.unlock()
+
+	now := c.now()
+	m := make(map[string]interface{}, len(old))
+	for k, v := range old {
+		if isExpired(now, v) {
+			continue
+		}
+		if data := resolve(v.data); data != nil {
+			m[k] = data
+		}
+	}
+	return m
+}
+
+// overwriteExpiry returns the expiry to use when overwriting a value expiring
+// at 'prev' with a value that would otherwise expire at 'next'.
+func (c *Cache) overwriteExpiry(prev, next time.Time) time.Time {
+	switch c.overwriteTTL {
+	case KeepExistingTTL:
+		return prev
+	case KeepLongerTTL:
+		// A zero time means no expiry, which is longer than any other.
+		if prev.IsZero() || (!next.IsZero() && prev.After(next)) {
+			return prev
+		}
+	}
+	return next
+}
+
+// NoExpiryTTL is the "time-to-live" returned by TTL and GetWithTTL for values
+// without an expiry (see Set).
+const NoExpiryTTL time.Duration = 0
+
+// GetWithTTL returns a value from the cache represented by the provided key,
+// its remaining "time-to-live", and true if it exists, read atomically. If the
+// value has no expiry, NoExpiryTTL is returned as its time-to-live.
+func (c *Cache) GetWithTTL(key string) (interface{}, time.Duration, bool) {
+	c.lock()
+	now := c.now()
+	v, ok := c.lockedRead(now, key)
+	c.unlock()
+	if !ok {
+		return nil, 0, false
+	}
+	val := c.output(c.materialize(key, v.data))
+	if val == nil {
+		return nil, 0, false
+	}
+	ttl := NoExpiryTTL
+	if !v.expireAt.IsZero() {
+		ttl = v.expireAt.Sub(now)
+	}
+	return val, ttl, true
+}
+
+// ExpireTime returns the time that the value represented by 'key' expires, and
+// true if it exists. The zero time is returned for values without an expiry.
+// Expired values are removed (see WithLazyExpiry).
+func (c *Cache) ExpireTime(key string) (time.Time, bool) {
+	c.lock()
+	defer c.unlock()
+	v, ok := c.lockedGet(c.now(), key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return v.expireAt, true
+}
+
 // TTL returns the "time-to-live" of the value represented by 'key'. If nothing
-// exists with the provided key, -1 is returned.
+// exists with the provided key, -1 is returned. If the value has no expiry,
+// NoExpiryTTL is returned.
 func (c *Cache) TTL(key string) time.Duration {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.rlock()
 	v, ok := c.objs[key]
+	c.runlock()
 	if !ok {
 		return -1
 	}
-
-	ttl := v.expireAt.Sub(time.Now())
-	if ttl <= 0 {
-		delete(c.objs, key)
+	if v.expireAt.IsZero() {
+		return NoExpiryTTL
+	}
+	if ttl := v.expireAt.Sub(c.now()); ttl > 0 {
+		return ttl
+	}
+	if !c.lazyExpiry {
 		return -1
 	}
+
+	// Remove the expired value, unless it was replaced in the meantime.
+	c.lock()
+	ttl := time.Duration(-1)
+	if v, ok = c.objs[key]; ok {
+		if v.expireAt.IsZero() {
+			ttl = NoExpiryTTL
+		} else if ttl = v.expireAt.Sub(c.now()); ttl <= 0 {
+			c.lockedRemove(key, v, Expired)
+			ttl = -1
+		}
+	}
+	c.unlock()
 	return ttl
 }
 
 func (c *Cache) cleaner() {
-	t := time.NewTimer(c.durClean)
+	c.logger.Printf("cache: cleaner started")
+	t := time.NewTimer(c.jittered(c.durClean))
 	defer t.Stop()
 	for {
 		select {
@@ -130,51 +1220,157 @@ func (c *Cache) cleaner() {
 		case <-t.C:
 		}
 
-		c.mu.Lock()
+		c.lock()
 
-		// Check if cache is closed or no keys left to expire.
-		if c.closed || len(c.objs) == 0 {
+		// Check if cache is closed or no values or failed loads left to
+		// expire.
+		if c.closed || (c.expiring == 0 && len(c.failed) == 0) {
 			c.chClean = nil
-			c.mu.Unlock()
+			c.unlock()
+			c.logger.Printf("cache: cleaner stopped")
 			return
 		}
 
-		c.expirer.lockedExpire(c)
+		start := time.Now()
+		cycle := c.lockedClean()
+		wait := c.cycleWait
 
-		c.mu.Unlock()
+		c.unlock()
+		cycle.Duration = time.Since(start)
+		c.logger.Printf("cache: cleaner removed %d of %d entries in %d batches (%v)",
+			cycle.Removed, cycle.Scanned, cycle.Batches, cycle.Duration)
+		if c.onCleanCycle != nil {
+			c.protect("clean cycle handler", func() { c.onCleanCycle(cycle) })
+		}
 		if !t.Stop() {
 			select {
 			case <-t.C:
 			default:
 			}
 		}
-		t.Reset(c.durClean)
+		next := c.jittered(c.nextCleanInterval(cycle.Duration - wait))
+		atomic.StoreInt64(&c.stats.cleanInterval, int64(next))
+		t.Reset(next)
+	}
+}
+
+// Clean immediately removes expired values using the configured Expirer (see
+// WithExpirer), rather than waiting for the cleaner. It is a no-op if the cache
+// has been closed.
+func (c *Cache) Clean() {
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return
+	}
+	c.lockedClean()
+}
+
+// relock re-acquires the cache's lock after it was released during a 'clean'
+// operation, recording the time spent waiting for it. The wait doesn't count
+// against the cleaner's CPU budget (see WithCleanerCPUBudget).
+func (c *Cache) relock() {
+	start := time.Now()
+	c.lock()
+	c.cycleWait += time.Since(start)
+}
+
+// lockedClean runs a single clean cycle, returning its stats.
+func (c *Cache) lockedClean() CleanStats {
+	c.cycle = CleanStats{}
+	c.cycleWait = 0
+	// The Expirer always returns with the cache locked, even if it panics.
+	c.protect("expirer", func() { c.expirer.lockedExpire(c) })
+	c.lockedResolveVetoes()
+	c.lockedExpireFailedLoads(c.now())
+	return c.cycle
+}
+
+// nextCleanInterval returns the duration to wait before the next 'clean'
+// operation, given the time spent working in the previous one.
+func (c *Cache) nextCleanInterval(cost time.Duration) time.Duration {
+	if c.cpuBudget <= 0 || c.cpuBudget >= 1 {
+		return c.durClean
+	}
+	if d := time.Duration(float64(cost)/c.cpuBudget) - cost; d > c.durClean {
+		return d
 	}
+	return c.durClean
+}
+
+// jittered returns 'd' randomized within the configured jitter fraction (see
+// WithCleanJitter).
+func (c *Cache) jittered(d time.Duration) time.Duration {
+	if c.jitter <= 0 {
+		return d
+	}
+	frac := c.jitter
+	if frac > 1 {
+		frac = 1
+	}
+	return d + time.Duration(float64(d)*frac*(2*rand.Float64()-1))
+}
+
+// now returns the current time used for expiry, as provided by the configured
+// Clock (see WithClock). By default, it includes a monotonic clock reading
+// (see the time package), unless the WithWallClockExpiry option is used.
+func (c *Cache) now() time.Time {
+	var now time.Time
+	if c.clock != nil {
+		now = c.clock.Now()
+	} else {
+		now = time.Now()
+	}
+	if c.wallClock {
+		return now.Round(0)
+	}
+	return now
 }
 
 func isExpired(now time.Time, v value) bool {
 	return !v.expireAt.IsZero() && now.After(v.expireAt)
 }
 
+func isStale(now time.Time, v value) bool {
+	return !v.staleAt.IsZero() && now.After(v.staleAt)
+}
+
 // ErrAlreadyClosed is the error returned from the Close method when the cache
-// has already been closed.
+// has already been closed, and from other methods that report errors when
+// called on a closed cache.
 var ErrAlreadyClosed = errors.New("cache: already closed")
 
 // Close shuts down the cache, emptying it and preventing new values from being
 // set.
 func (c *Cache) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.lock()
+	defer c.unlock()
 	if c.closed {
 		return ErrAlreadyClosed
 	}
 	c.closed = true
-	c.objs = nil
-	if c.chClean != nil {
-		select {
-		case c.chClean <- struct{}{}:
-		default:
+	close(c.done)
+	if c.coalescer != nil {
+		c.coalescer.discard()
+	}
+	if c.onEvict != nil || c.metrics != nil {
+		for k, v := range c.objs {
+			c.lockedNotify(k, v, Closed)
 		}
 	}
+	c.objs = nil
+	c.expiring = 0
+	c.expirer.reset()
+	c.bytes = 0
+	c.cost = 0
+	c.failed = nil
+	if c.eviction != nil {
+		c.eviction.reset()
+	}
+	c.populated = nil
+	c.inserted = nil
+	c.cardinality = nil
+	c.vetoPending = nil
+	c.lockedWakeCleaner()
 	return nil
 }
@@ -0,0 +1,605 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// panicExpirer is an Expirer that panics on its first 'clean' operation, and
+// expires all entries afterwards.
+type panicExpirer struct {
+	calls int32
+}
+
+func (e *panicExpirer) lockedExpire(c *Cache) {
+	if atomic.AddInt32(&e.calls, 1) == 1 {
+		panic("expirer failed")
+	}
+	c.lockedExpireAll(c.now())
+}
+
+func (e *panicExpirer) clone() Expirer      { return e }
+func (e *panicExpirer) onSet(string, value) {}
+func (e *panicExpirer) onDelete(string)     {}
+func (e *panicExpirer) reset()              {}
+
+// testLogger is a Logger that records all messages.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.msgs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor polls 'cond' until it returns true, failing the test if it doesn't
+// within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPanickingExpirerDoesNotStopCleaning(t *testing.T) {
+	e := &panicExpirer{}
+	logger := &testLogger{}
+	c := New(WithExpirer(e), WithCleanInterval(time.Millisecond), WithLogger(logger))
+	defer c.Close()
+
+	c.SetEx("a", 1, time.Millisecond)
+	waitFor(t, "expired value to be cleaned", func() bool {
+		return c.Len() == 0
+	})
+	if atomic.LoadInt32(&e.calls) < 2 {
+		t.Fatalf("expected the expirer to be called again after panicking")
+	}
+	if !logger.contains("expirer failed") {
+		t.Fatalf("expected the panic to be logged")
+	}
+
+	// The cache must remain usable, with the lock released.
+	c.Set("b", 2)
+	if v := c.Get("b"); v != 2 {
+		t.Fatalf("expected 2, got %v", v)
+	}
+}
+
+func TestCleanerStopsWhenDrained(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	c := New(WithClock(clock), WithCleanInterval(time.Hour))
+	defer c.Close()
+	cleanerRunning := func() bool {
+		c.lock()
+		defer c.unlock()
+		return c.chClean != nil
+	}
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		c.SetEx("a", 1, time.Second)
+		c.SetEx("b", 2, time.Second)
+		if !cleanerRunning() {
+			t.Fatalf("expected the cleaner to be running after refilling")
+		}
+		switch i % 3 {
+		case 0:
+			clock.Advance(2 * time.Second)
+			c.Clean()
+		case 1:
+			c.Delete("a")
+			c.Delete("b")
+		case 2:
+			c.Clear()
+		}
+		waitFor(t, "cleaner to stop", func() bool {
+			return !cleanerRunning() && runtime.NumGoroutine() <= base
+		})
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	for _, shared := range []bool{true, false} {
+		b.Run(fmt.Sprintf("shared=%v", shared), func(b *testing.B) {
+			c := New()
+			defer c.Close()
+			// Compare reads sharing the mutex with reads that take it
+			// exclusively.
+			c.sharedReads = shared
+			c.SetEx("key", "value", time.Hour)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if c.Get("key") == nil {
+						b.Fatal("expected a hit")
+					}
+				}
+			})
+		})
+	}
+}
+
+// deferredTTL behaves like TTL for values that haven't expired, but releases
+// the lock using defer, as a baseline for BenchmarkTTL.
+func (c *Cache) deferredTTL(key string) time.Duration {
+	v, ok := c.deferredLookup(key)
+	if !ok {
+		return -1
+	}
+	if v.expireAt.IsZero() {
+		return NoExpiryTTL
+	}
+	return v.expireAt.Sub(c.now())
+}
+
+// deferredGet behaves like Get for values that haven't expired, but releases
+// the lock using defer, as a baseline for BenchmarkGet.
+func (c *Cache) deferredGet(key string) interface{} {
+	v, ok := c.deferredLookup(key)
+	if !ok || isExpired(c.now(), v) {
+		c.recordMiss()
+		return nil
+	}
+	c.recordHit()
+	return c.output(c.materialize(key, v.data))
+}
+
+func (c *Cache) deferredLookup(key string) (value, bool) {
+	c.rlock()
+	defer c.runlock()
+	v, ok := c.objs[key]
+	return v, ok
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, deferred := range []bool{false, true} {
+		b.Run(fmt.Sprintf("deferred=%v", deferred), func(b *testing.B) {
+			c := New()
+			defer c.Close()
+			get := c.Get
+			if deferred {
+				get = c.deferredGet
+			}
+			c.SetEx("key", "value", time.Hour)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				get("key")
+			}
+		})
+	}
+}
+
+func BenchmarkTTL(b *testing.B) {
+	for _, deferred := range []bool{false, true} {
+		b.Run(fmt.Sprintf("deferred=%v", deferred), func(b *testing.B) {
+			c := New()
+			defer c.Close()
+			ttl := c.TTL
+			if deferred {
+				ttl = c.deferredTTL
+			}
+			c.SetEx("key", "value", time.Hour)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ttl("key")
+			}
+		})
+	}
+}
+
+// panickingRecorder is a MetricsRecorder that panics on every call.
+type panickingRecorder struct{}
+
+func (panickingRecorder) RecordHit()                 { panic("RecordHit failed") }
+func (panickingRecorder) RecordMiss()                { panic("RecordMiss failed") }
+func (panickingRecorder) RecordEviction(EvictReason) { panic("RecordEviction failed") }
+func (panickingRecorder) SetSize(int)                { panic("SetSize failed") }
+
+func TestPanickingCallbacksDoNotLeaveCacheLocked(t *testing.T) {
+	tests := []struct {
+		name string
+		op   Option
+	}{
+		{"read migration", WithReadMigration(func(interface{}) (interface{}, bool) {
+			panic("migration failed")
+		})},
+		{"sizer", WithValueSizer(func(interface{}) int64 { panic("sizer failed") })},
+		{"metrics recorder", WithMetrics(panickingRecorder{})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := &testLogger{}
+			c := New(test.op, WithMaxBytes(1<<20), WithLogger(logger))
+			defer c.Close()
+
+			c.Set("a", "value")
+			if v := c.Get("a"); v != "value" {
+				t.Fatalf("expected value, got %v", v)
+			}
+			c.Delete("a")
+			done := make(chan struct{})
+			go func() {
+				c.Len()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("cache was left locked")
+			}
+			if !logger.contains("failed") {
+				t.Fatalf("expected the panic to be logged")
+			}
+		})
+	}
+}
+
+func TestExpireHeapRemovesValueExpiringAtCleanTime(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	c := New(WithClock(clock), WithExpirer(NewExpireHeap()), WithCleanInterval(time.Hour))
+	defer c.Close()
+
+	c.SetEx("a", 1, time.Second)
+	// The value isn't expired yet when the clock reaches its expiry, so it
+	// must remain in the heap to be removed later.
+	clock.Advance(time.Second)
+	c.Clean()
+	clock.Advance(time.Second)
+	c.Clean()
+	if n := c.Len(); n != 0 {
+		t.Fatalf("expected the expired value to be removed, got %d values", n)
+	}
+}
+
+func TestGetOrSetPanicIsReturnedToWaiters(t *testing.T) {
+	c := New()
+	defer c.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		c.GetOrSet("a", time.Hour, func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("fn failed")
+		})
+	}()
+	<-started
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.GetOrSet("a", time.Hour, func() (interface{}, error) {
+			return 1, nil
+		})
+		errs <- err
+	}()
+	// Give the second caller time to start waiting on the in-flight call.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := <-errs; err == nil {
+		t.Fatalf("expected an error from the panicking call")
+	}
+	if _, ok := c.GetOK("a"); ok {
+		t.Fatalf("expected nothing to be cached")
+	}
+}
+
+// sizeRecorder is a MetricsRecorder that remembers the last reported size.
+type sizeRecorder struct {
+	mu   sync.Mutex
+	size int
+}
+
+func (r *sizeRecorder) RecordHit()                 {}
+func (r *sizeRecorder) RecordMiss()                {}
+func (r *sizeRecorder) RecordEviction(EvictReason) {}
+
+func (r *sizeRecorder) SetSize(n int) {
+	r.mu.Lock()
+	r.size = n
+	r.mu.Unlock()
+}
+
+func TestShardedMetricsReportTotalSize(t *testing.T) {
+	r := &sizeRecorder{}
+	s := NewSharded(4, WithMetrics(r))
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprint(i), i)
+	}
+	for i := 0; i < 10; i++ {
+		s.Delete(fmt.Sprint(i))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size != 90 {
+		t.Fatalf("expected a size of 90, got %d", r.size)
+	}
+}
+
+func TestShardedLargeEntryReporterReportsAllShards(t *testing.T) {
+	reports := make(chan []SizedKey, 100)
+	s := NewSharded(4, WithLargeEntryReporter(2, 20*time.Millisecond, func(sizes []SizedKey) {
+		reports <- sizes
+	}), WithValueSizer(func(v interface{}) int64 { return int64(v.(int)) }))
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprint(i), i)
+	}
+	sizes := <-reports
+	want := []SizedKey{{Key: "99", Size: 99}, {Key: "98", Size: 98}}
+	if fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, sizes)
+	}
+}
+
+func TestReusedOptionsDoNotShareState(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	ops := []Option{
+		WithClock(clock),
+		WithCleanInterval(time.Hour),
+		WithEviction(NewLRU()),
+		WithExpirer(NewExpireHeap()),
+		WithMaxSize(1),
+	}
+	a, b := New(ops...), New(ops...)
+	defer a.Close()
+	defer b.Close()
+
+	a.SetEx("a", 1, time.Second)
+	b.SetEx("b", 2, time.Second)
+	// Evicting from 'b' must not choose a key only held by 'a'.
+	b.SetEx("c", 3, time.Second)
+	if _, ok := b.GetOK("b"); ok {
+		t.Fatalf("expected 'b' to be evicted")
+	}
+	clock.Advance(2 * time.Second)
+	a.Clean()
+	b.Clean()
+	if n := a.Len() + b.Len(); n != 0 {
+		t.Fatalf("expected all values to be expired, got %d values", n)
+	}
+}
+
+func TestLazyExpiryFromMaterializationStartsOnRead(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	c := New(WithClock(clock), WithLazyExpiryFromMaterialization(), WithCleanInterval(time.Hour))
+	defer c.Close()
+
+	c.SetExLazy("a", func() interface{} { return 1 }, time.Second)
+	clock.Advance(2 * time.Second)
+	c.Clean()
+	if v := c.Get("a"); v != 1 {
+		t.Fatalf("expected the unread value to remain, got %v", v)
+	}
+	clock.Advance(2 * time.Second)
+	c.Clean()
+	if n := c.Len(); n != 0 {
+		t.Fatalf("expected the value to expire after being read, got %d values", n)
+	}
+}
+
+func TestSnapshotsKeepCost(t *testing.T) {
+	c := New(WithMaxCost(10))
+	defer c.Close()
+	c.SetExCost("a", 1, time.Hour, 5)
+	c.Set("b", 2)
+
+	var buf bytes.Buffer
+	if err := c.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromSnapshot := New(WithMaxCost(10))
+	defer fromSnapshot.Close()
+	if err := fromSnapshot.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := New(WithMaxCost(10))
+	defer fromJSON.Close()
+	if err := fromJSON.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Cache{fromSnapshot, fromJSON} {
+		c.lock()
+		cost := c.cost
+		c.unlock()
+		if cost != 6 {
+			t.Fatalf("expected a total cost of 6, got %d", cost)
+		}
+	}
+}
+
+func TestNewFromSnapshotKeepsPersistedEntries(t *testing.T) {
+	src := New()
+	defer src.Close()
+	src.Set("persisted", 1)
+	var persisted bytes.Buffer
+	if err := src.Snapshot(&persisted); err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/snapshot"
+	if err := os.WriteFile(path, persisted.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src.Delete("persisted")
+	src.Set("snapshot", 2)
+	src.Set("other", 3)
+	var snapshot bytes.Buffer
+	if err := src.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewFromSnapshot(&snapshot, WithPersistence(path, 0), WithStartingSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get("persisted"); v != 1 {
+		t.Fatalf("expected the persisted value to be kept, got %v", v)
+	}
+	if v := c.Get("snapshot"); v != 2 {
+		t.Fatalf("expected the snapshot value to be loaded, got %v", v)
+	}
+}
+
+func TestGetOrInitOnClosedCache(t *testing.T) {
+	c := New()
+	c.Close()
+	val, created := c.GetOrInit("a", time.Hour, func() interface{} {
+		t.Fatalf("expected init not to be called")
+		return 1
+	})
+	if val != nil || created {
+		t.Fatalf("expected nil and false, got %v and %v", val, created)
+	}
+}
+
+func TestScanReturnsEachKeyOnce(t *testing.T) {
+	c := New()
+	defer c.Close()
+	for i := 0; i < 1000; i++ {
+		c.Set(fmt.Sprint(i), i)
+	}
+
+	for _, count := range []int{1, 7, 1000, 5000} {
+		seen := make(map[string]int)
+		var cursor uint64
+		for {
+			keys, next := c.Scan(cursor, count)
+			if len(keys) > count {
+				t.Fatalf("count %d: expected at most %d keys, got %d", count, count, len(keys))
+			}
+			for _, k := range keys {
+				seen[k]++
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+		if len(seen) != 1000 {
+			t.Fatalf("count %d: expected 1000 keys, got %d", count, len(seen))
+		}
+		for k, n := range seen {
+			if n != 1 {
+				t.Fatalf("count %d: expected key %q once, got %d times", count, k, n)
+			}
+		}
+	}
+}
+
+func TestCleanerStopsWhenNoValuesExpire(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	c := New(WithClock(clock), WithCleanInterval(time.Hour))
+	defer c.Close()
+	cleanerRunning := func() bool {
+		c.lock()
+		defer c.unlock()
+		return c.chClean != nil
+	}
+
+	c.Set("a", 1)
+	c.SetEx("b", 2, time.Second)
+	if !cleanerRunning() {
+		t.Fatalf("expected the cleaner to be running")
+	}
+	clock.Advance(2 * time.Second)
+	c.Clean()
+	waitFor(t, "cleaner to stop", func() bool {
+		return !cleanerRunning()
+	})
+	if v := c.Get("a"); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+
+	c.SetEx("b", 2, time.Second)
+	if !cleanerRunning() {
+		t.Fatalf("expected the cleaner to be running")
+	}
+	c.Persist("b")
+	waitFor(t, "cleaner to stop", func() bool {
+		return !cleanerRunning()
+	})
+}
+
+func TestLongLivedKeysRequiresInsertionTracking(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	c := New(WithClock(clock))
+	defer c.Close()
+	c.Set("a", 1)
+	clock.Advance(time.Hour)
+	if keys := c.LongLivedKeys(time.Minute); keys != nil {
+		t.Fatalf("expected nil without insertion tracking, got %v", keys)
+	}
+
+	c = New(WithClock(clock), WithInsertionTracking())
+	defer c.Close()
+	c.Set("a", 1)
+	clock.Advance(time.Hour)
+	c.Set("b", 2)
+	if keys := c.LongLivedKeys(time.Minute); len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("expected [a], got %v", keys)
+	}
+	c.Delete("a")
+	c.lock()
+	n := len(c.inserted)
+	c.unlock()
+	if n != 1 {
+		t.Fatalf("expected the deleted key to be forgotten, got %d keys", n)
+	}
+}
@@ -0,0 +1,74 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import "time"
+
+// cardinalityGuard limits the number of distinct keys set within a rolling
+// window of time.
+type cardinalityGuard struct {
+	max    int
+	window time.Duration
+	seen   map[string]time.Time
+	// oldest is no later than the earliest time in 'seen', so that pruning
+	// can be skipped until a key may have left the window.
+	oldest time.Time
+}
+
+func newCardinalityGuard(max int, window time.Duration) *cardinalityGuard {
+	return &cardinalityGuard{
+		max:    max,
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// admit records that 'key' is being set at 'now', returning false if it is a
+// new distinct key and the limit has been reached.
+func (g *cardinalityGuard) admit(now time.Time, key string) bool {
+	if _, ok := g.seen[key]; !ok && len(g.seen) >= g.max {
+		g.prune(now)
+		if len(g.seen) >= g.max {
+			return false
+		}
+	}
+	g.seen[key] = now
+	return true
+}
+
+// prune removes all keys that were last set before the current window. It is
+// O(n) in the number of keys seen, which is limited to 'max'.
+func (g *cardinalityGuard) prune(now time.Time) {
+	cutoff := now.Add(-g.window)
+	if !g.oldest.Before(cutoff) {
+		return
+	}
+	g.oldest = time.Time{}
+	for k, at := range g.seen {
+		if at.Before(cutoff) {
+			delete(g.seen, k)
+		} else if g.oldest.IsZero() || at.Before(g.oldest) {
+			g.oldest = at
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+// GetChain returns the value represented by 'key' from the first of the
+// provided caches that contains it, along with the index of that cache. If no
+// cache contains the key, nil, -1, and false are returned.
+// When a value is found, it is set in each preceding cache that was created
+// with the WithChainBackfill option. Each cache is only locked for its own
+// operations.
+func GetChain(key string, caches ...*Cache) (interface{}, int, bool) {
+	for i, c := range caches {
+		v := c.Get(key)
+		if v == nil {
+			continue
+		}
+		for _, prev := range caches[:i] {
+			if prev.backfillTTL > 0 {
+				prev.SetEx(key, v, prev.backfillTTL)
+			}
+		}
+		return v, i, true
+	}
+	return nil, -1, false
+}
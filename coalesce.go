@@ -0,0 +1,110 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescer buffers writes to the cache, applying only the most recent write
+// for each key once per window.
+type coalescer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]value
+	timer   *time.Timer
+}
+
+// add buffers the value for the provided key, scheduling a flush of the
+// buffer if one isn't already scheduled.
+func (w *coalescer) add(c *Cache, key string, v value) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == nil {
+		w.pending = make(map[string]value)
+	}
+	w.pending[key] = v
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.window, func() { w.flush(c) })
+	}
+}
+
+// flush applies all buffered writes to the cache. The buffer is taken with the
+// cache locked, so that a write or delete can't be overwritten by an older
+// buffered write.
+func (w *coalescer) flush(c *Cache) {
+	c.lock()
+	defer c.unlock()
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.timer = nil
+	w.mu.Unlock()
+
+	now := c.now()
+	for k, v := range pending {
+		if c.lockedAcceptWrite() {
+			c.lockedStore(now, k, v)
+		}
+	}
+}
+
+// cancel drops the buffered write for the provided key, if any.
+func (w *coalescer) cancel(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, key)
+}
+
+// cancelPrefix drops the buffered writes for all keys starting with 'prefix'.
+func (w *coalescer) cancelPrefix(prefix string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for k := range w.pending {
+		if strings.HasPrefix(k, prefix) {
+			delete(w.pending, k)
+		}
+	}
+}
+
+// discard drops all buffered writes.
+func (w *coalescer) discard() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.pending = nil
+}
+
+// lockedCancelPending drops any buffered write for the provided key (see
+// WithWriteCoalescing), as it is superseded by a newer write or delete.
+func (c *Cache) lockedCancelPending(key string) {
+	if c.coalescer != nil {
+		c.coalescer.cancel(key)
+	}
+}
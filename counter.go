@@ -0,0 +1,117 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotInteger is the error returned from Increment and Decrement when
+	// the key holds a value that isn't an int64.
+	ErrNotInteger = errors.New("cache: value is not an int64")
+	// ErrWriteRejected is the error returned from Increment and Decrement
+	// when a new counter can't be set (see Stats.RejectedWrites).
+	ErrWriteRejected = errors.New("cache: write rejected")
+)
+
+// Increment atomically adds 'delta' to the int64 counter represented by 'key',
+// returning the new value of the counter. If the counter doesn't exist, it is
+// initialized to 'delta' with 'exp' as the expiry duration; the expiry of an
+// existing counter is unchanged. ErrNotInteger is returned if the key holds a
+// value that isn't an int64.
+func (c *Cache) Increment(key string, delta int64, exp time.Duration) (int64, error) {
+	c.lock()
+	defer c.unlock()
+	if !c.lockedAcceptWrite() {
+		return 0, ErrAlreadyClosed
+	}
+	now := c.now()
+	v, ok := c.lockedGet(now, key)
+	if !ok {
+		if !c.acceptWrite(delta, exp) || !c.lockedSet(now, key, value{expireAt: now.Add(exp), data: delta}) {
+			return 0, ErrWriteRejected
+		}
+		return delta, nil
+	}
+	n, isInt := resolve(v.data).(int64)
+	if !isInt {
+		return 0, ErrNotInteger
+	}
+	c.lockedCancelPending(key)
+	v.data = n + delta
+	v = c.lockedResize(v)
+	c.objs[key] = v
+	c.lockedTouch(key)
+	return n + delta, nil
+}
+
+// Decrement atomically subtracts 'delta' from the int64 counter represented by
+// 'key'. It is equivalent to calling Increment with '-delta'.
+func (c *Cache) Decrement(key string, delta int64, exp time.Duration) (int64, error) {
+	return c.Increment(key, -delta, exp)
+}
+
+// IncrementWithLimit adds 'delta' to the int64 counter represented by 'key',
+// but only if the result doesn't exceed 'limit'. If the counter doesn't exist,
+// it is initialized to zero with 'exp' as the expiry duration; the expiry of an
+// existing counter is unchanged, so 'exp' acts as a fixed window (e.g. for rate
+// limiting). It returns the new value of the counter and true, or the current
+// value and false if the increment would exceed the limit. If the key holds a
+// value that isn't an int64, or the counter can't be set, 0 and false are
+// returned.
+func (c *Cache) IncrementWithLimit(key string, delta, limit int64, exp time.Duration) (newVal int64, allowed bool) {
+	c.lock()
+	defer c.unlock()
+	if !c.lockedAcceptWrite() {
+		return 0, false
+	}
+	now := c.now()
+	v, ok := c.lockedGet(now, key)
+	var cur int64
+	if ok {
+		n, isInt := resolve(v.data).(int64)
+		if !isInt {
+			return 0, false
+		}
+		cur = n
+	}
+
+	next := cur + delta
+	if next > limit {
+		return cur, false
+	}
+	if ok {
+		c.lockedCancelPending(key)
+		v.data = next
+		v = c.lockedResize(v)
+		c.objs[key] = v
+		c.lockedTouch(key)
+		return next, true
+	}
+	if !c.acceptWrite(next, exp) || !c.lockedSet(now, key, value{expireAt: now.Add(exp), data: next}) {
+		return 0, false
+	}
+	return next, true
+}
@@ -0,0 +1,268 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+)
+
+// Eviction represents a policy for choosing which value to evict from a Cache
+// that has reached its maximum size (see WithMaxSize and WithEviction).
+type Eviction interface {
+	// clone returns an Eviction with the same policy and no state, so that
+	// each cache created with an Eviction has its own.
+	clone() Eviction
+	// touched records that the key was set or read.
+	touched(key string)
+	// removed records that the key was removed from the cache.
+	removed(key string)
+	// victim returns the key that should be evicted next.
+	victim() (string, bool)
+	// reset forgets all keys.
+	reset()
+}
+
+// NewLRU returns an Eviction that evicts the least recently used value, where
+// a value is used when it is set or read.
+func NewLRU() Eviction {
+	return &lru{
+		list:  list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+type lru struct {
+	list  *list.List
+	elems map[string]*list.Element
+}
+
+func (l *lru) clone() Eviction {
+	return NewLRU()
+}
+
+func (l *lru) touched(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.list.MoveToFront(e)
+		return
+	}
+	l.elems[key] = l.list.PushFront(key)
+}
+
+func (l *lru) removed(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.list.Remove(e)
+		delete(l.elems, key)
+	}
+}
+
+func (l *lru) victim() (string, bool) {
+	e := l.list.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+func (l *lru) reset() {
+	l.list.Init()
+	l.elems = make(map[string]*list.Element)
+}
+
+// EvictReason is the reason that a value was removed from a Cache. See
+// WithOnEvict.
+type EvictReason int
+
+const (
+	// Expired indicates that the value expired.
+	Expired EvictReason = iota
+	// Deleted indicates that the value was explicitly deleted.
+	Deleted
+	// Replaced indicates that the value was overwritten by a new value.
+	Replaced
+	// Evicted indicates that the value was evicted to make room for a new
+	// value (see WithMaxSize).
+	Evicted
+	// Closed indicates that the cache was closed.
+	Closed
+	// Cleared indicates that the cache was cleared (see Cache.Clear).
+	Cleared
+)
+
+// String returns the name of the reason.
+func (r EvictReason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Deleted:
+		return "deleted"
+	case Replaced:
+		return "replaced"
+	case Evicted:
+		return "evicted"
+	case Closed:
+		return "closed"
+	case Cleared:
+		return "cleared"
+	}
+	return "unknown"
+}
+
+// OnEvictFunc is called with a value that was removed from a Cache, and the
+// reason it was removed. See WithOnEvict.
+type OnEvictFunc func(key string, val interface{}, reason EvictReason)
+
+// eviction is a removed value awaiting a call to the OnEvict or OnExpire
+// function.
+type eviction struct {
+	key    string
+	val    interface{}
+	reason EvictReason
+}
+
+// lockedNotify records the removal of the provided value, queueing a call to
+// the OnEvict and OnExpire functions. Queued calls are made once the cache is
+// unlocked.
+func (c *Cache) lockedNotify(key string, v value, reason EvictReason) {
+	switch reason {
+	case Expired:
+		atomic.AddUint64(&c.stats.expirations, 1)
+	case Evicted:
+		atomic.AddUint64(&c.stats.evictions, 1)
+	}
+	if c.metrics != nil {
+		c.protect("metrics recorder", func() { c.metrics.RecordEviction(reason) })
+	}
+	if c.onEvict == nil && (c.onExpire == nil || reason != Expired) {
+		return
+	}
+	val := v.data
+	if l, ok := val.(*lazyValue); ok {
+		// Lazy values that were never computed aren't reported.
+		if !l.computed() {
+			return
+		}
+		val = l.val
+	}
+	if val != nil {
+		c.evicted = append(c.evicted, eviction{key: key, val: val, reason: reason})
+	}
+}
+
+// evictionSample is the maximum number of entries considered when choosing an
+// entry to evict without an Eviction policy.
+const evictionSample = 8
+
+// lockedMakeRoom evicts entries until there is room for a new entry.
+func (c *Cache) lockedMakeRoom(now time.Time) {
+	for len(c.objs) >= c.maxSize && len(c.objs) > 0 {
+		c.lockedEvictOne(now)
+	}
+}
+
+// lockedMakeRoomBytes evicts entries until there is room for a new value of
+// 'size' bytes for 'key', which may replace an existing value.
+func (c *Cache) lockedMakeRoomBytes(now time.Time, key string, size int64) {
+	for c.bytes-c.objs[key].size+size > c.maxBytes && len(c.objs) > 0 {
+		c.lockedEvictOne(now)
+	}
+}
+
+// lockedMakeRoomCost evicts entries until there is room for a new value of
+// 'cost' for 'key', which may replace an existing value.
+func (c *Cache) lockedMakeRoomCost(now time.Time, key string, cost int64) {
+	for c.cost-c.objs[key].cost+cost > c.maxCost && len(c.objs) > 0 {
+		c.lockedEvictOne(now)
+	}
+}
+
+// lockedEvictOne removes a single entry, chosen by the Eviction policy if one
+// is configured. Otherwise, an expired entry among a small sample of entries is
+// preferred.
+func (c *Cache) lockedEvictOne(now time.Time) {
+	if c.eviction != nil {
+		if victim, ok := c.eviction.victim(); ok {
+			c.lockedRemove(victim, c.objs[victim], Evicted)
+			return
+		}
+	}
+
+	var victim string
+	var n int
+	for k, v := range c.objs {
+		if n == 0 {
+			victim = k
+		}
+		if isExpired(now, v) {
+			victim = k
+			break
+		}
+		n++
+		if n >= evictionSample {
+			break
+		}
+	}
+	if v := c.objs[victim]; isExpired(now, v) {
+		c.lockedRemove(victim, v, Expired)
+	} else {
+		c.lockedRemove(victim, v, Evicted)
+	}
+}
+
+// lockedDelete removes the entry for the provided key.
+func (c *Cache) lockedDelete(key string) {
+	v, ok := c.objs[key]
+	c.bytes -= v.size
+	c.cost -= v.cost
+	delete(c.objs, key)
+	delete(c.inserted, key)
+	c.expirer.onDelete(key)
+	if c.eviction != nil {
+		c.eviction.removed(key)
+	}
+	if ok && !v.expireAt.IsZero() {
+		c.expiring--
+		if c.expiring == 0 {
+			c.lockedWakeCleaner()
+		}
+	}
+}
+
+// lockedRemove removes the entry for the provided key, queueing a call to the
+// OnEvict function with the provided reason. An explicit delete also discards
+// any buffered write for the key.
+func (c *Cache) lockedRemove(key string, v value, reason EvictReason) {
+	if reason == Deleted {
+		c.lockedCancelPending(key)
+	}
+	c.lockedDelete(key)
+	c.lockedNotify(key, v, reason)
+}
+
+// lockedTouch records that the entry for the provided key was used.
+func (c *Cache) lockedTouch(key string) {
+	if c.eviction != nil {
+		c.eviction.touched(key)
+	}
+}
@@ -23,13 +23,24 @@
 package cache
 
 import (
+	"container/heap"
 	"runtime"
 	"time"
 )
 
 // Expirer represents an expiry technique used by a Cache.
 type Expirer interface {
+	// clone returns an Expirer with the same configuration and no state, so
+	// that each cache created with an Expirer has its own.
+	clone() Expirer
 	lockedExpire(*Cache)
+	// onSet records that the value for the key was set, or that its expiry
+	// was changed. It may not be called if the expiry was only extended.
+	onSet(key string, v value)
+	// onDelete records that the value for the key was removed.
+	onDelete(key string)
+	// reset forgets all keys, as all values were removed at once.
+	reset()
 }
 
 // NewExpireAll returns an Expirer that will iterate through all entries in the
@@ -40,13 +51,20 @@ func NewExpireAll() Expirer {
 
 type expireAll struct{}
 
+func (e expireAll) clone() Expirer { return e }
+
 func (e expireAll) lockedExpire(c *Cache) {
-	lockedExpireAll(c.objs)
+	c.lockedExpireAll(c.now())
 }
 
+func (e expireAll) onSet(string, value) {}
+func (e expireAll) onDelete(string)     {}
+func (e expireAll) reset()              {}
+
 type expirePartial struct {
 	batchSize     int
 	continueRatio float64
+	maxHold       time.Duration
 }
 
 // NewExpirePartial returns an Expirer that will iterate through a maximum of
@@ -55,6 +73,15 @@ type expirePartial struct {
 // The advantage to using this Expirer is that entries may be get/set in between
 // batches. This makes this expiry method more performant for larger caches.
 func NewExpirePartial(batchSize int, continueRatio float64) Expirer {
+	return NewExpirePartialBudget(batchSize, continueRatio, 0)
+}
+
+// NewExpirePartialBudget returns an Expirer that behaves like the one returned
+// from NewExpirePartial, but additionally ends a batch early once the cache has
+// been locked for 'maxHold'. This bounds the time that other operations may
+// wait on the cleaner, even while it is expiring many entries.
+// A non-positive 'maxHold' disables the budget.
+func NewExpirePartialBudget(batchSize int, continueRatio float64, maxHold time.Duration) Expirer {
 	if batchSize <= 0 {
 		batchSize = 1
 	}
@@ -66,52 +93,171 @@ func NewExpirePartial(batchSize int, continueRatio float64) Expirer {
 	return expirePartial{
 		batchSize:     batchSize,
 		continueRatio: continueRatio,
+		maxHold:       maxHold,
 	}
 }
 
+func (e expirePartial) clone() Expirer      { return e }
+func (e expirePartial) onSet(string, value) {}
+func (e expirePartial) onDelete(string)     {}
+func (e expirePartial) reset()              {}
+
 func (e expirePartial) lockedExpire(c *Cache) {
-	if e.batchSize >= len(c.objs) {
-		lockedExpireAll(c.objs)
+	if e.maxHold <= 0 && e.batchSize >= len(c.objs) {
+		c.lockedExpireAll(c.now())
 		return
 	}
 	for {
-		now := time.Now()
-		if lockedExpireSome(now, e.batchSize, c.objs) < e.continueRatio {
+		var deadline time.Time
+		if e.maxHold > 0 {
+			deadline = time.Now().Add(e.maxHold)
+		}
+		scanned, expired := c.lockedExpireSome(c.now(), deadline, e.batchSize)
+		c.cycle.Batches++
+		c.cycle.Scanned += scanned
+		c.cycle.Removed += expired
+		if scanned == 0 || float64(expired)/float64(scanned) < e.continueRatio {
 			return
 		}
-		c.mu.Unlock()
+		c.unlock()
 		runtime.Gosched()
-		c.mu.Lock()
+		c.relock()
 		if c.closed {
 			return
 		}
 	}
 }
 
-func lockedExpireAll(m map[string]value) {
-	now := time.Now()
-	for k, v := range m {
-		if isExpired(now, v) {
-			delete(m, k)
+func (c *Cache) lockedExpireAll(now time.Time) {
+	c.cycle.Batches++
+	for k, v := range c.objs {
+		c.cycle.Scanned++
+		if isExpired(now, v) && c.lockedExpireEntry(k, v) {
+			c.cycle.Removed++
 		}
 	}
 }
 
-func lockedExpireSome(now time.Time, size int, m map[string]value) float64 {
+// deadlineCheckInterval is the number of entries between checks of the
+// deadline in lockedExpireSome.
+const deadlineCheckInterval = 32
+
+// lockedExpireSome checks up to 'size' entries for expiry, returning the
+// number of entries checked and the number that were expired.
+func (c *Cache) lockedExpireSome(now, deadline time.Time, size int) (scanned, expired int) {
 	var count int
-	var expired int
-	for k, v := range m {
-		if isExpired(now, v) {
+	for k, v := range c.objs {
+		if isExpired(now, v) && c.lockedExpireEntry(k, v) {
 			expired++
-			delete(m, k)
 		}
 		count++
 		if count >= size {
 			break
 		}
+		if !deadline.IsZero() && count%deadlineCheckInterval == 0 && time.Now().After(deadline) {
+			break
+		}
 	}
-	if count == 0 {
-		return 0.0
+	return count, expired
+}
+
+// NewExpireHeap returns an Expirer that keeps the keys of values with an
+// expiry in a min-heap ordered by expiry time, so that each 'clean' operation
+// only visits values that are due to expire. This is more efficient than the
+// other Expirers for caches holding many values that are far from expiry, at
+// the cost of additional memory for each value with an expiry.
+func NewExpireHeap() Expirer {
+	return &expireHeap{index: make(map[string]*heapItem)}
+}
+
+type heapItem struct {
+	key      string
+	expireAt time.Time
+	pos      int
+}
+
+// expireHeap is a min-heap of keys ordered by expiry time. Items may hold an
+// earlier expiry than their value if the value's expiry was extended, and are
+// corrected once they reach the top of the heap.
+type expireHeap struct {
+	items []*heapItem
+	index map[string]*heapItem
+}
+
+func (h *expireHeap) Len() int           { return len(h.items) }
+func (h *expireHeap) Less(i, j int) bool { return h.items[i].expireAt.Before(h.items[j].expireAt) }
+
+func (h *expireHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].pos = i
+	h.items[j].pos = j
+}
+
+func (h *expireHeap) Push(x interface{}) {
+	it := x.(*heapItem)
+	it.pos = len(h.items)
+	h.items = append(h.items, it)
+}
+
+func (h *expireHeap) Pop() interface{} {
+	n := len(h.items) - 1
+	it := h.items[n]
+	h.items[n] = nil
+	h.items = h.items[:n]
+	return it
+}
+
+func (h *expireHeap) clone() Expirer {
+	return NewExpireHeap()
+}
+
+func (h *expireHeap) onSet(key string, v value) {
+	if v.expireAt.IsZero() {
+		h.onDelete(key)
+		return
+	}
+	if it, ok := h.index[key]; ok {
+		it.expireAt = v.expireAt
+		heap.Fix(h, it.pos)
+		return
+	}
+	it := &heapItem{key: key, expireAt: v.expireAt}
+	h.index[key] = it
+	heap.Push(h, it)
+}
+
+func (h *expireHeap) onDelete(key string) {
+	if it, ok := h.index[key]; ok {
+		heap.Remove(h, it.pos)
+		delete(h.index, key)
+	}
+}
+
+func (h *expireHeap) reset() {
+	h.items = nil
+	h.index = make(map[string]*heapItem)
+}
+
+func (h *expireHeap) lockedExpire(c *Cache) {
+	now := c.now()
+	c.cycle.Batches++
+	for len(h.items) > 0 {
+		it := h.items[0]
+		if !now.After(it.expireAt) {
+			return
+		}
+		c.cycle.Scanned++
+		v, ok := c.objs[it.key]
+		if ok && !v.expireAt.IsZero() && !v.expireAt.Equal(it.expireAt) {
+			// The value's expiry has changed since the item was updated.
+			it.expireAt = v.expireAt
+			heap.Fix(h, 0)
+			continue
+		}
+		heap.Pop(h)
+		delete(h.index, it.key)
+		if ok && isExpired(now, v) && c.lockedExpireEntry(it.key, v) {
+			c.cycle.Removed++
+		}
 	}
-	return float64(expired) / float64(count)
 }
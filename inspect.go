@@ -0,0 +1,234 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// ValueHasher returns a hash of the provided value. See WithValueHasher.
+type ValueHasher func(val interface{}) uint64
+
+// fingerprintBucket is the granularity of expiry times in a fingerprint.
+const fingerprintBucket = time.Second
+
+// Fingerprint returns a hash of the unexpired contents of the cache. Two
+// caches with the same keys, values, and expiry times (to the second) have the
+// same fingerprint.
+// Values are hashed using the configured ValueHasher (see WithValueHasher).
+// The default hasher only supports strings, byte slices, booleans, and numeric
+// types; values of all other types are hashed by their type alone.
+// This is O(n log n) in the size of the cache.
+func (c *Cache) Fingerprint() uint64 {
+	type entry struct {
+		key      string
+		data     interface{}
+		expireAt time.Time
+	}
+
+	c.lock()
+	now := c.now()
+	entries := make([]entry, 0, len(c.objs))
+	for k, v := range c.objs {
+		if !isExpired(now, v) {
+			entries = append(entries, entry{key: k, data: v.data, expireAt: v.expireAt})
+		}
+	}
+	c.unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	hasher := c.valueHasher
+	if hasher == nil {
+		hasher = defaultValueHasher
+	}
+	h := fnv.New64a()
+	var buf [16]byte
+	for _, e := range entries {
+		var bucket int64
+		if !e.expireAt.IsZero() {
+			bucket = e.expireAt.Truncate(fingerprintBucket).Unix()
+		}
+		binary.BigEndian.PutUint64(buf[:8], hasher(resolve(e.data)))
+		binary.BigEndian.PutUint64(buf[8:], uint64(bucket))
+		h.Write([]byte(e.key))
+		h.Write([]byte{0})
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+func defaultValueHasher(val interface{}) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%T:", val)
+	switch v := val.(type) {
+	case string:
+		h.Write([]byte(v))
+	case []byte:
+		h.Write(v)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32,
+		uint64, uintptr, float32, float64, complex64, complex128:
+		fmt.Fprint(h, v)
+	}
+	return h.Sum64()
+}
+
+// Map returns a map of all unexpired keys and values in the cache, read
+// atomically with respect to any writes.
+func (c *Cache) Map() map[string]interface{} {
+	c.lock()
+	now := c.now()
+	m := make(map[string]interface{}, len(c.objs))
+	for k, v := range c.objs {
+		if !isExpired(now, v) {
+			m[k] = v.data
+		}
+	}
+	c.unlock()
+
+	for k, data := range m {
+		if val := c.output(resolve(data)); val != nil {
+			m[k] = val
+		} else {
+			delete(m, k)
+		}
+	}
+	return m
+}
+
+// Keys returns the unexpired keys in the cache, deleting any expired entries
+// that are encountered (see WithLazyExpiry). The returned slice is newly
+// allocated, so this is O(n) in the size of the cache.
+func (c *Cache) Keys() []string {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	keys := make([]string, 0, len(c.objs))
+	for k, v := range c.objs {
+		if isExpired(now, v) {
+			c.lockedRemoveExpired(k, v)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Range calls 'fn' for each unexpired key and value in the cache, stopping
+// early if 'fn' returns false. Any expired entries that are encountered are
+// deleted (see WithLazyExpiry).
+// Note: the cache is locked for the duration of the iteration, so 'fn' must
+// not call any methods on the cache.
+func (c *Cache) Range(fn func(key string, val interface{}) bool) {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	for k, v := range c.objs {
+		if isExpired(now, v) {
+			c.lockedRemoveExpired(k, v)
+			continue
+		}
+		val := c.output(resolve(v.data))
+		if val == nil {
+			continue
+		}
+		if !fn(k, val) {
+			return
+		}
+	}
+}
+
+// UnreadKeys returns the unexpired keys whose values have not been read since
+// they were set.
+// Note: this requires the WithAccessTracking option; without it, nil is
+// returned.
+func (c *Cache) UnreadKeys() []string {
+	if !c.trackAccess {
+		return nil
+	}
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	var keys []string
+	for k, v := range c.objs {
+		if v.reads == 0 && !isExpired(now, v) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// LongLivedKeys returns the unexpired keys whose values were set more than
+// 'threshold' ago. Extending the expiry of a value (e.g. with
+// GetAndExtendMulti) doesn't reset the time it was set, so this can be used to
+// find values that are kept alive for much longer than their original
+// expiry duration.
+// Note: this requires the WithInsertionTracking option; without it, nil is
+// returned.
+func (c *Cache) LongLivedKeys(threshold time.Duration) []string {
+	if c.inserted == nil {
+		return nil
+	}
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	var keys []string
+	for k, v := range c.objs {
+		if !isExpired(now, v) && now.Sub(c.inserted[k]) > threshold {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// GroupByTTL returns the unexpired keys in the cache grouped by their
+// remaining time-to-live. 'buckets' holds the upper bounds of each group in
+// ascending order; a key is placed in the group with the index of the first
+// bucket its time-to-live doesn't exceed, or at index len(buckets) if it
+// exceeds all of them or has no expiry. Groups without any keys are omitted.
+func (c *Cache) GroupByTTL(buckets []time.Duration) map[int][]string {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	groups := make(map[int][]string)
+	for k, v := range c.objs {
+		if isExpired(now, v) {
+			continue
+		}
+		i := len(buckets)
+		if !v.expireAt.IsZero() {
+			ttl := v.expireAt.Sub(now)
+			i = sort.Search(len(buckets), func(i int) bool {
+				return ttl <= buckets[i]
+			})
+		}
+		groups[i] = append(groups[i], k)
+	}
+	return groups
+}
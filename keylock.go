@@ -0,0 +1,89 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import "time"
+
+// TryLock attempts to acquire a lock represented by 'key' on behalf of
+// 'owner', held for a lease of 'ttl'. It returns true if the lock was
+// acquired, which is only possible if the key is not set. The owner is stored
+// as the key's value.
+func (c *Cache) TryLock(key, owner string, ttl time.Duration) bool {
+	if !c.acceptWrite(owner, ttl) {
+		return false
+	}
+	c.lock()
+	defer c.unlock()
+	if !c.lockedAcceptWrite() {
+		return false
+	}
+	now := c.now()
+	if _, ok := c.lockedGet(now, key); ok {
+		return false
+	}
+	return c.lockedSet(now, key, value{expireAt: now.Add(ttl), data: owner})
+}
+
+// Unlock releases the lock represented by 'key' if it is held by 'owner',
+// returning true if the lock was released. A lock whose lease has expired is
+// no longer held by its owner, and may have been acquired by another.
+func (c *Cache) Unlock(key, owner string) bool {
+	c.lock()
+	defer c.unlock()
+	v, ok := c.lockedOwnedLock(c.now(), key, owner)
+	if !ok {
+		return false
+	}
+	c.lockedRemove(key, v, Deleted)
+	return true
+}
+
+// RenewLock extends the lease of the lock represented by 'key' to 'ttl' from
+// now if it is held by 'owner', returning true if the lease was renewed.
+func (c *Cache) RenewLock(key, owner string, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	v, ok := c.lockedOwnedLock(now, key, owner)
+	if !ok {
+		return false
+	}
+	v = c.withExpiry(now, v, now.Add(ttl))
+	c.lockedPut(key, v)
+	c.expirer.onSet(key, v)
+	return true
+}
+
+// lockedOwnedLock returns the value of the lock represented by 'key', and true
+// if it is held by 'owner'.
+func (c *Cache) lockedOwnedLock(now time.Time, key, owner string) (value, bool) {
+	v, ok := c.lockedGet(now, key)
+	if !ok {
+		return v, false
+	}
+	cur, ok := v.data.(string)
+	return v, ok && cur == owner
+}
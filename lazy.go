@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lazyValue is a value whose computation is deferred until it is first read.
+type lazyValue struct {
+	once sync.Once
+	fn   func() interface{}
+	exp  time.Duration
+	val  interface{}
+	done uint32
+}
+
+func (l *lazyValue) get() interface{} {
+	l.once.Do(func() {
+		l.val = l.fn()
+		l.fn = nil
+		atomic.StoreUint32(&l.done, 1)
+	})
+	return l.val
+}
+
+// computed returns true if the value has been computed.
+func (l *lazyValue) computed() bool {
+	return atomic.LoadUint32(&l.done) == 1
+}
+
+// SetExLazy sets the provided key to the result of calling 'thunk', using
+// 'exp' as the expiry duration. The thunk is not called until the value is
+// first read, and is called at most once, even with concurrent readers. If the
+// thunk returns nil, the key is removed.
+// The expiry duration starts when SetExLazy is called, unless the
+// WithLazyExpiryFromMaterialization option is used, in which case the value
+// has no expiry until it is first read.
+// Note: some operations (e.g. SetIfNewer) may call the thunk while the cache
+// is locked, so it must not call any methods on the cache.
+func (c *Cache) SetExLazy(key string, thunk func() interface{}, exp time.Duration) {
+	if thunk == nil {
+		c.acceptWrite(nil, exp)
+		return
+	}
+	l := &lazyValue{fn: thunk, exp: exp}
+	if !c.acceptWrite(l, exp) {
+		return
+	}
+	c.lock()
+	defer c.unlock()
+	if c.lockedAcceptWrite() {
+		now := c.now()
+		var expireAt time.Time
+		if !c.lazyExpiryFromRead {
+			expireAt = now.Add(exp)
+		}
+		c.lockedSet(now, key, value{expireAt: expireAt, data: l})
+	}
+}
+
+// materialize returns the value for the provided data read from 'key'. If the
+// data is a lazy value, it is computed and replaces the lazy value in the
+// cache. The cache must not be locked.
+func (c *Cache) materialize(key string, data interface{}) interface{} {
+	l, ok := data.(*lazyValue)
+	if !ok {
+		return data
+	}
+	val := l.get()
+	if data, ok := c.migrated(val); ok {
+		val = data
+	}
+
+	c.lock()
+	defer c.unlock()
+	cur, ok := c.objs[key]
+	if !ok {
+		return val
+	}
+	if cl, ok := cur.data.(*lazyValue); !ok || cl != l {
+		return val
+	}
+	if val == nil {
+		c.lockedDelete(key)
+		return nil
+	}
+	cur.data = val
+	cur = c.lockedResize(cur)
+	if c.lazyExpiryFromRead {
+		now := c.now()
+		cur = c.withExpiry(now, cur, now.Add(l.exp))
+		c.expirer.onSet(key, cur)
+		c.lockedStartCleaner()
+	}
+	c.lockedPut(key, cur)
+	return val
+}
+
+// resolve returns the value for the provided data, computing it if it is a
+// lazy value. Unlike materialize, it may be called while the cache is locked.
+func resolve(data interface{}) interface{} {
+	if l, ok := data.(*lazyValue); ok {
+		return l.get()
+	}
+	return data
+}
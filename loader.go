@@ -0,0 +1,306 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// LoaderFunc loads the value for the provided key, returning the value, the
+// duration it should be cached for, and any error that occurred.
+type LoaderFunc func(key string) (interface{}, time.Duration, error)
+
+// call represents an in-flight or completed call to a loader.
+type call struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// GetErr returns a value from the cache represented by the provided key. If
+// the key is missing and a loader is configured (see WithDefaultLoader,
+// WithColdLoader, and WithRefreshLoader), the loader is called to populate the
+// cache, and any error returned from the loader is returned (see also
+// WithNegativeTTL). If the cache has been closed, ErrAlreadyClosed is
+// returned.
+func (c *Cache) GetErr(key string) (interface{}, error) {
+	c.lock()
+	if c.closed {
+		c.unlock()
+		return nil, ErrAlreadyClosed
+	}
+	now := c.now()
+	v, ok := c.lockedRead(now, key)
+	if ok {
+		if c.staleGrace > 0 && isStale(now, v) {
+			// Refresh the stale value in the background, unless a load is
+			// already in flight.
+			if fn := c.lockedLoaderFor(key); fn != nil {
+				c.lockedCall(key, fn)
+			}
+		}
+		c.unlock()
+		return c.output(c.materialize(key, v.data)), nil
+	}
+	if err := c.lockedFailedLoad(now, key); err != nil {
+		c.unlock()
+		return nil, err
+	}
+	fn := c.lockedLoaderFor(key)
+	if fn == nil {
+		c.unlock()
+		return nil, nil
+	}
+	cl := c.lockedCall(key, fn)
+	c.unlock()
+
+	<-cl.done
+	return c.output(cl.val), cl.err
+}
+
+// GetOrSet returns the value represented by the provided key. If no value
+// exists, 'fn' is called without the cache locked, and the value it returns is
+// set using 'exp' as the expiry duration, and returned. Concurrent callers for
+// the same missing key wait for a single call to 'fn' (or to a loader, see
+// GetErr) and share its result. Errors returned from 'fn' are returned to all
+// waiting callers, and nothing is cached.
+func (c *Cache) GetOrSet(key string, exp time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	return c.GetOrSetCtx(context.Background(), key, exp, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// GetOrSetCtx behaves like GetOrSet, but calls 'fn' with 'ctx'. If 'ctx' is
+// done while waiting for another caller's call to 'fn', its error is returned
+// immediately. If 'ctx' is done by the time 'fn' returns, its error is
+// returned to all waiting callers, and nothing is cached. If 'fn' panics, the
+// panic is propagated to this caller, and waiting callers get an error.
+func (c *Cache) GetOrSetCtx(ctx context.Context, key string, exp time.Duration, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	c.lock()
+	if c.closed {
+		c.unlock()
+		return nil, ErrAlreadyClosed
+	}
+	v, ok := c.lockedRead(c.now(), key)
+	if ok {
+		c.unlock()
+		return c.output(c.materialize(key, v.data)), nil
+	}
+	if cl, ok := c.calls[key]; ok {
+		c.unlock()
+		select {
+		case <-cl.done:
+			return c.output(cl.val), cl.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*call)
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.unlock()
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			cl.val, cl.err = nil, fmt.Errorf("cache: GetOrSet function panicked: %v", r)
+		}
+		c.lock()
+		delete(c.calls, key)
+		if cl.err == nil && c.acceptWrite(cl.val, exp) && c.lockedAcceptWrite() {
+			now := c.now()
+			c.lockedSet(now, key, value{expireAt: now.Add(exp), data: cl.val})
+		}
+		c.unlock()
+		close(cl.done)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	cl.val, cl.err = fn(ctx)
+	if cl.err == nil && ctx.Err() != nil {
+		cl.val, cl.err = nil, ctx.Err()
+	}
+	return c.output(cl.val), cl.err
+}
+
+func (c *Cache) hasLoader() bool {
+	return c.loader != nil || c.coldLoader != nil || c.refreshLoader != nil
+}
+
+// lockedLoaderFor returns the loader to use for the provided missing key, or
+// nil if there is none.
+func (c *Cache) lockedLoaderFor(key string) LoaderFunc {
+	if c.refreshLoader != nil {
+		if _, ok := c.populated[key]; ok {
+			return c.refreshLoader
+		}
+	}
+	if c.coldLoader != nil {
+		if _, ok := c.populated[key]; !ok {
+			return c.coldLoader
+		}
+	}
+	return c.loader
+}
+
+// lockedCall returns the in-flight call for the provided key, starting a new
+// call to 'fn' if none exists. Only one call per key is made at a time.
+func (c *Cache) lockedCall(key string, fn LoaderFunc) *call {
+	if cl, ok := c.calls[key]; ok {
+		return cl
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*call)
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	go c.doCall(key, cl, fn)
+	return cl
+}
+
+func (c *Cache) doCall(key string, cl *call, fn LoaderFunc) {
+	var exp time.Duration
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Printf("cache: recovered from panic in loader: %v", r)
+			cl.val, cl.err = nil, fmt.Errorf("cache: loader panicked: %v", r)
+		}
+		c.lock()
+		delete(c.calls, key)
+		if cl.err == nil {
+			c.lockedSetLoaded(key, cl.val, exp)
+		} else if c.negativeTTL > 0 && !c.closed {
+			if c.failed == nil {
+				c.failed = make(map[string]failedLoad)
+			}
+			c.failed[key] = failedLoad{err: cl.err, expireAt: c.now().Add(c.negativeTTL)}
+			c.lockedStartCleaner()
+		}
+		c.unlock()
+		close(cl.done)
+	}()
+	cl.val, exp, cl.err = fn(key)
+}
+
+// failedLoad is an error returned from a loader, remembered until 'expireAt'.
+// See WithNegativeTTL.
+type failedLoad struct {
+	err      error
+	expireAt time.Time
+}
+
+// lockedFailedLoad returns the remembered error from a failed load of the
+// provided key, or nil if there is none.
+func (c *Cache) lockedFailedLoad(now time.Time, key string) error {
+	f, ok := c.failed[key]
+	if !ok {
+		return nil
+	}
+	if now.After(f.expireAt) {
+		delete(c.failed, key)
+		return nil
+	}
+	return f.err
+}
+
+// lockedExpireFailedLoads forgets all remembered errors from failed loads that
+// have expired.
+func (c *Cache) lockedExpireFailedLoads(now time.Time) {
+	for k, f := range c.failed {
+		if now.After(f.expireAt) {
+			delete(c.failed, k)
+		}
+	}
+}
+
+// lockedSetLoaded sets a value returned from a loader, applying the configured
+// LoaderZeroTTLPolicy if the loader returned a non-positive expiry duration.
+func (c *Cache) lockedSetLoaded(key string, val interface{}, exp time.Duration) {
+	now := c.now()
+	expireAt, ok := c.loadedExpiry(now, exp)
+	if !ok {
+		return
+	}
+	if c.acceptValue(val) && c.lockedAcceptWrite() {
+		c.lockedSet(now, key, value{expireAt: expireAt, data: val})
+	}
+}
+
+// loadedExpiry returns the expiry time for a value returned from a loader with
+// the provided expiry duration, or false if the value should not be cached.
+func (c *Cache) loadedExpiry(now time.Time, exp time.Duration) (time.Time, bool) {
+	if exp > 0 {
+		return now.Add(exp), true
+	}
+	switch c.loaderZeroTTL {
+	case NoExpiry:
+		return time.Time{}, true
+	case UseDefaultTTL:
+		if c.loaderDefaultTTL > 0 {
+			return now.Add(c.loaderDefaultTTL), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ReloadIfChanged calls 'loader' to load the authoritative value for the
+// provided key. If the cached value is equal to the loaded value according to
+// 'equals', the cached value is kept and returned, and its expiry is extended
+// using the loaded expiry duration. Otherwise, the loaded value is set and
+// returned. Any error returned from the loader is returned, leaving the cache
+// unchanged.
+// Note: 'loader' is called without the cache locked, but 'equals' is called
+// while the cache is locked, so it must not call any methods on the cache.
+func (c *Cache) ReloadIfChanged(key string, loader func() (interface{}, time.Duration, error), equals func(a, b interface{}) bool) (interface{}, error) {
+	val, exp, err := loader()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return nil, ErrAlreadyClosed
+	}
+	now := c.now()
+	if v, ok := c.lockedGet(now, key); ok {
+		cur := resolve(v.data)
+		if equals(cur, val) {
+			if expireAt, ok := c.loadedExpiry(now, exp); ok {
+				v.data = cur
+				v = c.lockedResize(v)
+				v = c.withExpiry(now, v, expireAt)
+				c.lockedPut(key, v)
+				c.expirer.onSet(key, v)
+			}
+			return c.output(cur), nil
+		}
+	}
+	c.lockedSetLoaded(key, val, exp)
+	return c.output(val), nil
+}
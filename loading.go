@@ -0,0 +1,64 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+// LoadingCache is a Cache that populates missing keys using a loader. See
+// NewLoading.
+type LoadingCache struct {
+	c *Cache
+}
+
+// NewLoading returns an initialized LoadingCache using any provided option,
+// that calls 'loader' to populate the cache when a missing key is requested.
+// The duration returned from the loader is used as the value's expiry duration
+// (see WithLoaderZeroTTL for non-positive durations).
+func NewLoading(loader LoaderFunc, ops ...Option) *LoadingCache {
+	// Limit the capacity so that appending never modifies the caller's slice.
+	ops = append(ops[:len(ops):len(ops)], WithDefaultLoader(loader))
+	return &LoadingCache{c: New(ops...)}
+}
+
+// Cache returns the underlying Cache.
+func (l *LoadingCache) Cache() *Cache {
+	return l.c
+}
+
+// Close shuts down the cache, emptying it and preventing new values from being
+// set.
+func (l *LoadingCache) Close() error {
+	return l.c.Close()
+}
+
+// Delete removes the value represented by the provided key, returning true if
+// an unexpired value was removed.
+func (l *LoadingCache) Delete(key string) bool {
+	return l.c.Delete(key)
+}
+
+// Get returns the value represented by the provided key, calling the loader if
+// it is missing. Concurrent calls for the same missing key share a single call
+// to the loader. Errors returned from the loader are returned to all waiting
+// callers, and nothing is cached.
+func (l *LoadingCache) Get(key string) (interface{}, error) {
+	return l.c.GetErr(key)
+}
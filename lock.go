@@ -0,0 +1,100 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// lock acquires the cache's mutex. If re-entrancy detection is enabled, it
+// panics when called by the goroutine already holding the mutex.
+func (c *Cache) lock() {
+	if !c.detectReentrancy {
+		c.mu.Lock()
+		return
+	}
+	id := goroutineID()
+	if atomic.LoadUint64(&c.owner) == id {
+		panic("cache: re-entrant call while the cache is locked by the same goroutine")
+	}
+	c.mu.Lock()
+	atomic.StoreUint64(&c.owner, id)
+}
+
+// unlock reports the size of the cache (see WithMetrics) and releases the
+// cache's mutex, then calls the OnEvict and OnExpire functions for any values
+// that were removed while it was held.
+func (c *Cache) unlock() {
+	c.lockedRecordSize()
+	evicted := c.evicted
+	c.evicted = nil
+	if c.detectReentrancy {
+		atomic.StoreUint64(&c.owner, 0)
+	}
+	c.mu.Unlock()
+	for _, e := range evicted {
+		if c.onEvict != nil {
+			c.protect("OnEvict function", func() { c.onEvict(e.key, e.val, e.reason) })
+		}
+		if c.onExpire != nil && e.reason == Expired {
+			c.protect("OnExpire function", func() { c.onExpire(e.key, e.val) })
+		}
+	}
+}
+
+// rlock acquires the cache's mutex for reading, allowing concurrent readers.
+// If re-entrancy detection is enabled, the mutex is acquired exclusively.
+func (c *Cache) rlock() {
+	if c.detectReentrancy {
+		c.lock()
+		return
+	}
+	c.mu.RLock()
+}
+
+// runlock releases the cache's mutex acquired by rlock.
+func (c *Cache) runlock() {
+	if c.detectReentrancy {
+		c.unlock()
+		return
+	}
+	c.mu.RUnlock()
+}
+
+var goroutinePrefix = []byte("goroutine ")
+
+// goroutineID returns the ID of the current goroutine, parsed from the header
+// of its stack trace. This is slow, and is only used for debugging.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, goroutinePrefix)
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
@@ -0,0 +1,71 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import "sync/atomic"
+
+// MetricsRecorder receives measurements from a Cache as they happen, so that
+// they can be exported to a metrics system (e.g. as Prometheus counters and
+// gauges). See WithMetrics.
+// Note: methods may be called while the cache is locked, so they must be fast
+// and must not call any methods on the cache. Panics are recovered and logged
+// (see WithLogger).
+type MetricsRecorder interface {
+	// RecordHit records a read of an unexpired value.
+	RecordHit()
+	// RecordMiss records a read of a missing or expired value.
+	RecordMiss()
+	// RecordEviction records the removal of a value for the provided reason.
+	RecordEviction(reason EvictReason)
+	// SetSize records the number of entries in the cache. It is called at most
+	// once per locked operation, and only when the number has changed.
+	SetSize(n int)
+}
+
+// recordHit records a cache hit.
+func (c *Cache) recordHit() {
+	atomic.AddUint64(&c.stats.hits, 1)
+	if c.metrics != nil {
+		c.protect("metrics recorder", c.metrics.RecordHit)
+	}
+}
+
+// recordMiss records a cache miss.
+func (c *Cache) recordMiss() {
+	atomic.AddUint64(&c.stats.misses, 1)
+	if c.metrics != nil {
+		c.protect("metrics recorder", c.metrics.RecordMiss)
+	}
+}
+
+// lockedRecordSize reports the number of entries in the cache to the
+// MetricsRecorder if it has changed since it was last reported.
+func (c *Cache) lockedRecordSize() {
+	if c.metrics == nil {
+		return
+	}
+	if n := len(c.objs); n != c.metricsSize {
+		c.metricsSize = n
+		c.protect("metrics recorder", func() { c.metrics.SetSize(n) })
+	}
+}
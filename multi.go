@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// KV is a key and value pair.
+type KV struct {
+	Key   string
+	Value interface{}
+}
+
+// ErrDuplicateKey is the error returned from SetMultiPairs when the provided
+// pairs contain a duplicate key and the DuplicateError policy is used.
+var ErrDuplicateKey = errors.New("cache: duplicate key")
+
+// SetMultiPairs sets the provided key and value pairs, in order, using 'exp'
+// as the expiry duration. Keys that appear more than once are resolved using
+// the configured DuplicateKeyPolicy (see WithDuplicateKeyPolicy). With the
+// DuplicateError policy, ErrDuplicateKey is returned and no values are set.
+// All values are set atomically.
+func (c *Cache) SetMultiPairs(pairs []KV, exp time.Duration) error {
+	if c.duplicates == DuplicateError {
+		seen := make(map[string]struct{}, len(pairs))
+		for _, p := range pairs {
+			if _, ok := seen[p.Key]; ok {
+				return ErrDuplicateKey
+			}
+			seen[p.Key] = struct{}{}
+		}
+	}
+
+	var seen map[string]struct{}
+	if c.duplicates == FirstWins {
+		seen = make(map[string]struct{}, len(pairs))
+	}
+
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	for _, p := range pairs {
+		if seen != nil {
+			if _, ok := seen[p.Key]; ok {
+				continue
+			}
+			seen[p.Key] = struct{}{}
+		}
+		if c.acceptWrite(p.Value, exp) && c.lockedAcceptWrite() {
+			c.lockedSet(now, p.Key, value{expireAt: now.Add(exp), data: p.Value})
+		}
+	}
+	return nil
+}
+
+// SetMany sets the provided keys and values using 'exp' as the expiry duration.
+// All values are set atomically.
+func (c *Cache) SetMany(entries map[string]interface{}, exp time.Duration) {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	for k, val := range entries {
+		if c.acceptWrite(val, exp) && c.lockedAcceptWrite() {
+			c.lockedSet(now, k, value{expireAt: now.Add(exp), data: val})
+		}
+	}
+}
+
+// GetMany returns the values represented by the provided keys, read atomically
+// with respect to any writes. Missing and expired keys are omitted from the
+// result.
+func (c *Cache) GetMany(keys []string) map[string]interface{} {
+	c.lock()
+	now := c.now()
+	m := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if v, ok := c.lockedRead(now, key); ok {
+			m[key] = v.data
+		}
+	}
+	c.unlock()
+
+	for key, data := range m {
+		if val := c.output(c.materialize(key, data)); val != nil {
+			m[key] = val
+		} else {
+			delete(m, key)
+		}
+	}
+	return m
+}
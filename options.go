@@ -30,6 +30,23 @@ type Option interface {
 	modify(*options)
 }
 
+// WithAccessTracking causes the cache to count the number of times each value
+// is read, which is required by UnreadKeys. This adds a small overhead to
+// every read.
+func WithAccessTracking() Option {
+	return modifyFn(func(ops *options) {
+		ops.accessTracking = true
+	})
+}
+
+// WithChainBackfill causes values found in later caches by GetChain to be set
+// in the cache, using 'exp' as the expiry duration.
+func WithChainBackfill(exp time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.chainBackfill = exp
+	})
+}
+
 // WithCleanInterval sets the interval that 'clean' operations are run.
 // Default: 10 seconds.
 func WithCleanInterval(dur time.Duration) Option {
@@ -38,14 +55,481 @@ func WithCleanInterval(dur time.Duration) Option {
 	})
 }
 
+// WithCleanJitter randomizes each interval between 'clean' operations within
+// plus or minus 'fraction' of the clean interval (see WithCleanInterval), so
+// that the cleaners of many caches created together don't run at the same
+// time. 'fraction' is limited to the range [0, 1].
+// Default: 0 (no jitter).
+func WithCleanJitter(fraction float64) Option {
+	return modifyFn(func(ops *options) {
+		ops.cleanJitter = fraction
+	})
+}
+
+// WithCleanCycleHandler sets a function that is called after each 'clean'
+// operation, describing the work it performed. The function is called without
+// the cache locked.
+func WithCleanCycleHandler(fn func(CleanStats)) Option {
+	return modifyFn(func(ops *options) {
+		ops.cleanCycleHandler = fn
+	})
+}
+
+// WithCleanerCPUBudget limits the cleaner to using roughly 'fraction' of a
+// single CPU. After each 'clean' operation, the interval until the next one is
+// lengthened as needed to keep the ratio of time spent cleaning to time spent
+// waiting within the budget. The clean interval is never shortened.
+// Time spent waiting to re-acquire the cache's lock between batches of a
+// 'clean' operation is excluded, so contention with other callers doesn't
+// throttle the cleaner as if it were busy.
+// A fraction outside of the range (0, 1) disables the budget.
+func WithCleanerCPUBudget(fraction float64) Option {
+	return modifyFn(func(ops *options) {
+		ops.cleanerCPUBudget = fraction
+	})
+}
+
+// WithColdLoader sets a loader that is called to populate the cache when Get
+// or GetErr is called with a key that has never been set in the cache. It
+// takes precedence over any default loader (see WithDefaultLoader).
+// Note: tracking which keys have been set requires memory for every distinct
+// key ever set. This state is discarded by Clear, Close, and Rotate.
+func WithColdLoader(fn LoaderFunc) Option {
+	return modifyFn(func(ops *options) {
+		ops.coldLoader = fn
+	})
+}
+
+// WithClock sets the Clock used to determine the current time for expiry,
+// which defaults to the system clock. This allows expiry to be tested using a
+// ManualClock.
+// Note: the cleaner still runs at intervals of real time, and any time budgets
+// (e.g. WithCleanerCPUBudget) are always measured in real time.
+func WithClock(clock Clock) Option {
+	return modifyFn(func(ops *options) {
+		ops.clock = clock
+	})
+}
+
+// WithCodec sets the Codec used to marshal and unmarshal values in snapshots
+// (see Snapshot and Load).
+// Default: GobCodec.
+func WithCodec(codec Codec) Option {
+	return modifyFn(func(ops *options) {
+		ops.codec = codec
+	})
+}
+
+// WithCopyBytesOnGet causes Get to return a copy of any []byte value, so that
+// callers are free to modify the returned slice without altering the cached
+// value. Values of other types are returned as-is.
+// Note: this results in an allocation and copy for every []byte value returned.
+func WithCopyBytesOnGet() Option {
+	return modifyFn(func(ops *options) {
+		ops.copyBytesOnGet = true
+	})
+}
+
+// WithExpiryVeto sets a function that is called by the cleaner for each
+// expired entry before it is removed. If the function returns true and a
+// positive duration, the entry is kept, and expires after the returned
+// duration instead.
+// The function is called without the cache locked, so may perform slow
+// operations (e.g. revalidating against a source of truth). Entries that are
+// read or modified while the function is being called are not affected by its
+// result. Expired entries found by reads are removed without consulting the
+// function.
+func WithExpiryVeto(fn VetoFunc) Option {
+	return modifyFn(func(ops *options) {
+		ops.expiryVeto = fn
+	})
+}
+
 // WithExpirer sets the expiry method used by the cache during 'clean'
-// operations.
+// operations. Each cache created with the option uses its own copy of the
+// Expirer, so it may be shared.
 func WithExpirer(e Expirer) Option {
 	return modifyFn(func(ops *options) {
 		ops.expirer = e
 	})
 }
 
+// OverwriteTTLPolicy determines the expiry applied when SetEx overwrites an
+// existing, unexpired value.
+type OverwriteTTLPolicy int
+
+const (
+	// ReplaceTTL replaces the existing expiry with the newly provided one.
+	ReplaceTTL OverwriteTTLPolicy = iota
+	// KeepExistingTTL updates the value, but keeps the existing expiry.
+	KeepExistingTTL
+	// KeepLongerTTL updates the value, keeping whichever of the existing or
+	// new expiry is later. A value without an expiry is never given one.
+	KeepLongerTTL
+)
+
+// WithDefaultLoader sets a loader that is called to populate the cache when
+// Get or GetErr is called with a missing key. Concurrent calls for the same
+// missing key result in a single call to the loader.
+// Note: with a default loader, Get blocks until the loader returns for missing
+// keys.
+func WithDefaultLoader(fn LoaderFunc) Option {
+	return modifyFn(func(ops *options) {
+		ops.loader = fn
+	})
+}
+
+// DuplicateKeyPolicy determines how SetMultiPairs handles a key that appears
+// more than once.
+type DuplicateKeyPolicy int
+
+const (
+	// LastWins sets the last value provided for the key.
+	LastWins DuplicateKeyPolicy = iota
+	// FirstWins sets the first value provided for the key.
+	FirstWins
+	// DuplicateError rejects the entire batch.
+	DuplicateError
+)
+
+// WithDuplicateKeyPolicy sets the policy used by SetMultiPairs for keys that
+// appear more than once.
+// Default: LastWins.
+func WithDuplicateKeyPolicy(policy DuplicateKeyPolicy) Option {
+	return modifyFn(func(ops *options) {
+		ops.duplicateKeys = policy
+	})
+}
+
+// WithEviction sets the policy used to choose which value to evict when the
+// cache has reached its maximum size (see WithMaxSize), e.g. NewLRU(). Each
+// cache created with the option uses its own copy of the Eviction, so it may
+// be shared.
+// Default: an arbitrary value, preferring those that have expired.
+func WithEviction(e Eviction) Option {
+	return modifyFn(func(ops *options) {
+		ops.eviction = e
+	})
+}
+
+// WithExpirableValues causes values implementing the Expirable interface to
+// expire at the earlier of their own expiry and the expiry provided to SetEx.
+func WithExpirableValues() Option {
+	return modifyFn(func(ops *options) {
+		ops.expirableValues = true
+	})
+}
+
+// WithInsertionTracking causes the cache to record the time each value is set,
+// which is required by LongLivedKeys. This adds a small overhead to every
+// write.
+func WithInsertionTracking() Option {
+	return modifyFn(func(ops *options) {
+		ops.insertionTracking = true
+	})
+}
+
+// WithLargeEntryReporter calls 'fn' every 'interval' with up to 'topN' of the
+// largest entries in the cache, ordered from largest to smallest, as estimated
+// by the configured Sizer (see WithValueSizer). To bound the cost of each
+// report, only a sample of up to 1024 entries is considered. Lazy values that
+// haven't been computed (see SetExLazy) are not reported.
+func WithLargeEntryReporter(topN int, interval time.Duration, fn func([]SizedKey)) Option {
+	return modifyFn(func(ops *options) {
+		ops.largeEntryTopN = topN
+		ops.largeEntryInterval = interval
+		ops.largeEntryFn = fn
+	})
+}
+
+// WithLazyExpiry sets whether expired values are removed when they are read.
+// When disabled, expired values are treated as missing when read, but are only
+// removed by the cleaner, so reads of expired values don't need to lock the
+// cache exclusively. The tradeoff is that the memory held by expired values is
+// only reclaimed by the next 'clean' operation.
+// Default: true.
+func WithLazyExpiry(enabled bool) Option {
+	return modifyFn(func(ops *options) {
+		ops.lazyExpiry = enabled
+	})
+}
+
+// WithLazyExpiryFromMaterialization causes the expiry duration of values set
+// using SetExLazy to start when the value is first read, rather than when it
+// was set. Values that are never read don't expire, although they may still be
+// evicted.
+func WithLazyExpiryFromMaterialization() Option {
+	return modifyFn(func(ops *options) {
+		ops.lazyExpiryFromRead = true
+	})
+}
+
+// LoaderZeroTTLPolicy determines how a value is cached when a loader returns
+// a non-positive expiry duration. In all cases, the value is still returned to
+// the caller.
+type LoaderZeroTTLPolicy int
+
+const (
+	// DontCache does not cache the value.
+	DontCache LoaderZeroTTLPolicy = iota
+	// NoExpiry caches the value without an expiry.
+	NoExpiry
+	// UseDefaultTTL caches the value using the duration provided to the
+	// WithLoaderDefaultTTL option. If no default is set, the value is not
+	// cached.
+	UseDefaultTTL
+)
+
+// WithLoaderDefaultTTL sets the expiry duration used for loaded values when
+// the UseDefaultTTL policy is used (see WithLoaderZeroTTL).
+func WithLoaderDefaultTTL(exp time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.loaderDefaultTTL = exp
+	})
+}
+
+// WithLoaderZeroTTL sets the policy used when a loader returns a non-positive
+// expiry duration.
+// Default: DontCache.
+func WithLoaderZeroTTL(policy LoaderZeroTTLPolicy) Option {
+	return modifyFn(func(ops *options) {
+		ops.loaderZeroTTL = policy
+	})
+}
+
+// WithLogger sets a Logger that receives low-volume diagnostic messages, such
+// as the cleaner starting and stopping, the result of each 'clean' operation,
+// errors saving or loading snapshots (see WithPersistence), and panics
+// recovered from in user-provided functions called by the cache's goroutines.
+// Nothing is logged by operations that read or write individual values.
+// Default: messages are discarded.
+func WithLogger(l Logger) Option {
+	return modifyFn(func(ops *options) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		ops.logger = l
+	})
+}
+
+// WithMaxBytes limits the estimated total size of values in the cache to 'n'
+// bytes, as estimated by the configured Sizer (see WithValueSizer). When a
+// value is set that would exceed the limit, existing values are evicted to make
+// room for it, as with WithMaxSize. Values larger than 'n' are rejected. A
+// non-positive 'n' means the size of the cache is unlimited.
+// Default: 0.
+func WithMaxBytes(n int64) Option {
+	return modifyFn(func(ops *options) {
+		ops.maxBytes = n
+	})
+}
+
+// WithMaxCardinality limits the number of distinct keys that may be set within
+// a rolling window of duration 'window' to 'n'. Once the limit is reached,
+// attempts to set keys not set within the window are rejected until older keys
+// age out of the window. This protects against an unbounded number of
+// distinct keys, even when their values expire quickly.
+func WithMaxCardinality(n int, window time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.maxCardinality = n
+		ops.cardinalityWindow = window
+	})
+}
+
+// WithMaxCost limits the total cost of values in the cache to 'n' (see
+// SetExCost). When a value is set that would exceed the limit, existing values
+// are evicted to make room for it, as with WithMaxSize. Values with a cost
+// larger than 'n' are rejected. A non-positive 'n' means the total cost is
+// unlimited.
+// Default: 0.
+func WithMaxCost(n int64) Option {
+	return modifyFn(func(ops *options) {
+		ops.maxCost = n
+	})
+}
+
+// WithMaxSize limits the cache to holding 'n' values. When a new key is set in
+// a full cache, existing values are evicted to make room for it, preferring
+// values that have expired. A non-positive 'n' means the cache is unlimited.
+// Default: 0.
+func WithMaxSize(n int) Option {
+	return modifyFn(func(ops *options) {
+		ops.maxSize = n
+	})
+}
+
+// WithMaxTTL limits the expiry duration of values to 'd'. Any longer expiry
+// duration (e.g. passed to SetEx or Touch) is reduced to 'd'. A non-positive
+// 'd' means expiry durations are unlimited.
+// Default: 0.
+func WithMaxTTL(d time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.maxTTL = d
+	})
+}
+
+// WithMetrics sets a MetricsRecorder that is notified of hits, misses, and
+// removed values, and of changes to the number of entries in the cache.
+// Default: nil.
+func WithMetrics(m MetricsRecorder) Option {
+	return modifyFn(func(ops *options) {
+		ops.metrics = m
+	})
+}
+
+// WithMinTTL raises the expiry duration of values to at least 'd'. Any shorter
+// positive expiry duration (e.g. passed to SetEx or Touch) is increased to
+// 'd', which reduces how often short-lived values must be cleaned. A
+// non-positive 'd' means there is no minimum.
+// Note: if 'd' exceeds the maximum set with WithMaxTTL, the maximum is used.
+// Default: 0.
+func WithMinTTL(d time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.minTTL = d
+	})
+}
+
+// WithNegativeTTL causes errors returned from a loader (see WithDefaultLoader)
+// to be remembered for 'exp'. Until then, GetErr returns the same error for the
+// key without calling the loader again, unless a value is set for the key. The
+// remembered errors are not values, so they are not otherwise visible (e.g. to
+// Get or Len).
+func WithNegativeTTL(exp time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.negativeTTL = exp
+	})
+}
+
+// WithOnEvict sets a function that is called with each value removed from the
+// cache, along with the reason it was removed. Values returned from Rotate are
+// not reported.
+//
+// The function is called without the cache locked, on the goroutine that
+// removed the value, once it has released the lock. Values removed together
+// while the lock was held (e.g. a batch of expired values removed by the
+// cleaner) are reported in the order they were removed, but reports from
+// different goroutines may interleave. A panic in the function is recovered
+// from and logged (see WithLogger).
+func WithOnEvict(fn OnEvictFunc) Option {
+	return modifyFn(func(ops *options) {
+		ops.onEvict = fn
+	})
+}
+
+// WithOnExpire sets a function that is called with each value removed from the
+// cache because it expired, whether by the cleaner or when it was read. It is
+// not called for values removed for any other reason (see WithOnEvict).
+//
+// As with WithOnEvict, the function is called without the cache locked, once
+// the goroutine that removed the value has released the lock. Values expired
+// together by a single batch of the cleaner are reported together, in the
+// order they were removed.
+func WithOnExpire(fn func(key string, val interface{})) Option {
+	return modifyFn(func(ops *options) {
+		ops.onExpire = fn
+	})
+}
+
+// WithOverwriteTTLPolicy sets the policy used to determine the expiry of a
+// value that overwrites an existing, unexpired value.
+// Default: ReplaceTTL.
+func WithOverwriteTTLPolicy(policy OverwriteTTLPolicy) Option {
+	return modifyFn(func(ops *options) {
+		ops.overwriteTTL = policy
+	})
+}
+
+// maxPiggybackExpiry is the maximum number of entries that may be checked for
+// expiry by each read.
+const maxPiggybackExpiry = 64
+
+// WithPiggybackExpiry causes each read from the cache to also check up to 'n'
+// other entries for expiry, removing any that have expired. This spreads the
+// work of expiry across reads, reducing the work required of the cleaner.
+// 'n' is limited to 64 to keep the latency of reads predictable.
+func WithPiggybackExpiry(n int) Option {
+	return modifyFn(func(ops *options) {
+		if n > maxPiggybackExpiry {
+			n = maxPiggybackExpiry
+		}
+		ops.piggybackExpiry = n
+	})
+}
+
+// WithPersistence loads the cache from the snapshot file at 'path' when it is
+// created (if the file exists), and saves a snapshot of the cache to 'path'
+// every 'interval' until it is closed (see Snapshot). Each snapshot is written
+// to a temporary file that replaces 'path' once complete, so a failed save
+// leaves the previous snapshot intact; failures are logged (see WithLogger),
+// and saving is retried on the next interval. Changes made since the last save
+// are lost when the cache is closed.
+func WithPersistence(path string, interval time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.persistPath = path
+		ops.persistInterval = interval
+	})
+}
+
+// WithReadMigration sets a function that is applied to values as they are
+// read from the cache. If the function reports that it changed the value, the
+// new value replaces the existing one (keeping its expiry) and is returned.
+// This allows cached values to be lazily upgraded to a new representation.
+// Note: the function is called while the cache is locked, so it must be fast
+// and must not call any methods on the cache. It should report no change for
+// values that have already been migrated. If it panics, the panic is logged
+// (see WithLogger) and the value is left unchanged.
+func WithReadMigration(fn MigrateFunc) Option {
+	return modifyFn(func(ops *options) {
+		ops.readMigration = fn
+	})
+}
+
+// WithRefreshLoader sets a loader that is called to populate the cache when
+// Get or GetErr is called with a missing key that has previously been set in
+// the cache (e.g. after it has expired). It takes precedence over any default
+// loader (see WithDefaultLoader).
+// Note: tracking which keys have been set requires memory for every distinct
+// key ever set. This state is discarded by Clear, Close, and Rotate.
+func WithRefreshLoader(fn LoaderFunc) Option {
+	return modifyFn(func(ops *options) {
+		ops.refreshLoader = fn
+	})
+}
+
+// WithReentrancyDetection causes the cache to panic when one of its methods
+// is called by a goroutine that is already holding the cache's lock (e.g. from
+// within a callback), rather than deadlocking.
+// This adds significant overhead to every operation, and should only be used
+// during development and testing.
+func WithReentrancyDetection() Option {
+	return modifyFn(func(ops *options) {
+		ops.detectReentrancy = true
+	})
+}
+
+// WithSlidingExpiration enables sliding expiration, where each read of an
+// unexpired value extends its expiry by the duration it was set with (or last
+// touched with, see Touch). Values without an expiry are unaffected.
+func WithSlidingExpiration() Option {
+	return modifyFn(func(ops *options) {
+		ops.slidingExpiry = true
+	})
+}
+
+// WithStaleWhileRevalidate causes values that have expired within the last
+// 'grace' to be returned by Get and GetErr, while the configured loader (see
+// WithDefaultLoader and WithRefreshLoader) refreshes them in the background.
+// Only one refresh per key is made at a time. Values that expired more than
+// 'grace' ago are treated as missing. This has no effect without a loader.
+// Note: values are kept in the cache for the grace period past their expiry,
+// which is included in their "time-to-live" (see TTL). Values within the grace
+// period are reported as stale by GetStale.
+func WithStaleWhileRevalidate(grace time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.staleGrace = grace
+	})
+}
+
 // WithStartingSize creates the cache optimized to contain 'n' values.
 func WithStartingSize(n int) Option {
 	return modifyFn(func(ops *options) {
@@ -53,15 +537,115 @@ func WithStartingSize(n int) Option {
 	})
 }
 
+// WithValueHasher sets the function used to hash values when computing the
+// fingerprint of the cache (see Fingerprint).
+func WithValueHasher(fn ValueHasher) Option {
+	return modifyFn(func(ops *options) {
+		ops.valueHasher = fn
+	})
+}
+
+// WithValueSizer sets the function used to estimate the size of values.
+// Default: the length of string and byte slice values, and zero for values of
+// all other types.
+// Note: with WithMaxBytes, the function is called while the cache is locked,
+// so it must be fast and must not call any methods on the cache. If it panics,
+// the panic is logged (see WithLogger) and the value is sized as zero.
+func WithValueSizer(fn Sizer) Option {
+	return modifyFn(func(ops *options) {
+		ops.sizer = fn
+	})
+}
+
+// WithWallClockExpiry causes expiry to be determined using the wall clock
+// rather than the monotonic clock.
+//
+// By default, the expiry of a value is measured using the monotonic clock, so
+// that the time-to-live of values is unaffected by changes to the wall clock
+// (e.g. NTP adjustments). Depending on the platform, the monotonic clock may
+// not advance while the machine is suspended. With this option, values expire
+// at an absolute wall clock time, and will expire while the machine is
+// suspended, or if the wall clock jumps forward.
+func WithWallClockExpiry() Option {
+	return modifyFn(func(ops *options) {
+		ops.wallClockExpiry = true
+	})
+}
+
+// WithWriteCoalescing causes values set using SetEx to be buffered for up to
+// 'window' before being applied to the cache. If the same key is set multiple
+// times within the window, only the most recent value is applied. This reduces
+// contention on the cache's lock for keys that are frequently overwritten.
+// Note: values set using SetEx are not visible to reads until the window has
+// elapsed, even to the goroutine that set them. A buffered value is discarded
+// if its key is written or deleted before it is applied, and all buffered
+// values are discarded when the cache is cleared, rotated, or closed.
+func WithWriteCoalescing(window time.Duration) Option {
+	return modifyFn(func(ops *options) {
+		ops.coalesceWindow = window
+	})
+}
+
 var defaultOptions = options{
 	cleanInterval: 10 * time.Second,
+	codec:         GobCodec{},
 	expirer:       NewExpirePartial(1000, 0.2),
+	lazyExpiry:    true,
+	logger:        nopLogger{},
+	sizer:         defaultSizer,
 }
 
 type options struct {
-	cleanInterval time.Duration
-	expirer       Expirer
-	startingSize  int
+	accessTracking     bool
+	cardinalityWindow  time.Duration
+	chainBackfill      time.Duration
+	cleanCycleHandler  func(CleanStats)
+	cleanInterval      time.Duration
+	cleanJitter        float64
+	cleanerCPUBudget   float64
+	clock              Clock
+	coalesceWindow     time.Duration
+	codec              Codec
+	coldLoader         LoaderFunc
+	copyBytesOnGet     bool
+	detectReentrancy   bool
+	duplicateKeys      DuplicateKeyPolicy
+	eviction           Eviction
+	expirableValues    bool
+	expirer            Expirer
+	expiryVeto         VetoFunc
+	insertionTracking  bool
+	largeEntryFn       func([]SizedKey)
+	largeEntryInterval time.Duration
+	largeEntryTopN     int
+	lazyExpiry         bool
+	lazyExpiryFromRead bool
+	loader             LoaderFunc
+	loaderDefaultTTL   time.Duration
+	loaderZeroTTL      LoaderZeroTTLPolicy
+	logger             Logger
+	maxBytes           int64
+	maxCardinality     int
+	maxCost            int64
+	maxSize            int
+	maxTTL             time.Duration
+	metrics            MetricsRecorder
+	minTTL             time.Duration
+	negativeTTL        time.Duration
+	onEvict            OnEvictFunc
+	onExpire           func(key string, val interface{})
+	overwriteTTL       OverwriteTTLPolicy
+	persistInterval    time.Duration
+	persistPath        string
+	piggybackExpiry    int
+	readMigration      MigrateFunc
+	refreshLoader      LoaderFunc
+	sizer              Sizer
+	slidingExpiry      bool
+	staleGrace         time.Duration
+	startingSize       int
+	valueHasher        ValueHasher
+	wallClockExpiry    bool
 }
 
 type modifyFn func(*options)
@@ -0,0 +1,198 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// Entry represents a single key and value in the cache.
+type Entry struct {
+	Key   string
+	Value interface{}
+	// ExpireAt is the time the value expires, or the zero time if it has no
+	// expiry.
+	ExpireAt time.Time
+}
+
+// streamChunkSize is the number of entries read per lock acquisition by
+// Stream.
+const streamChunkSize = 128
+
+// Stream returns a channel that receives all unexpired entries in the cache.
+// The channel is closed once all entries have been sent, or 'ctx' is done.
+//
+// The keys in the cache are collected when Stream is called, and their values
+// are then read in small chunks, so the cache is never locked for long. As a
+// result, entries are weakly consistent: keys set after Stream is called are
+// not sent, keys removed before their value is read are skipped, and values
+// reflect the time they were read rather than the time Stream was called.
+func (c *Cache) Stream(ctx context.Context) <-chan Entry {
+	c.lock()
+	now := c.now()
+	keys := make([]string, 0, len(c.objs))
+	for k, v := range c.objs {
+		if !isExpired(now, v) {
+			keys = append(keys, k)
+		}
+	}
+	c.unlock()
+
+	ch := make(chan Entry)
+	go func() {
+		defer close(ch)
+		entries := make([]Entry, 0, streamChunkSize)
+		for len(keys) > 0 {
+			n := streamChunkSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			chunk := keys[:n]
+			keys = keys[n:]
+
+			entries = entries[:0]
+			c.lock()
+			now := c.now()
+			for _, k := range chunk {
+				if v, ok := c.lockedGet(now, k); ok {
+					entries = append(entries, Entry{Key: k, Value: v.data, ExpireAt: v.expireAt})
+				}
+			}
+			c.unlock()
+
+			for _, e := range entries {
+				if e.Value = c.output(resolve(e.Value)); e.Value == nil {
+					continue
+				}
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// Scan returns up to 'count' live keys, starting from the provided cursor, and
+// the cursor to provide to the following call. Iteration starts with a cursor
+// of 0, and is complete when the returned cursor is 0.
+//
+// The cache is only locked for reading for the duration of each call, so keys
+// are weakly consistent: keys set or deleted between calls may or may not be
+// returned, and a key may be returned more than once if it is deleted and set
+// again. Keys present for the entire iteration will be returned exactly once.
+// Each call is O(n log count) in the size of the cache.
+func (c *Cache) Scan(cursor uint64, count int) (keys []string, next uint64) {
+	if count <= 0 {
+		count = 10
+	}
+
+	// Keep the 'count' smallest hashes from the cursor in a max-heap, along
+	// with any keys sharing the largest of them, as keys sharing a hash must
+	// be returned together (the cursor can't represent a position between
+	// them).
+	var h scanHeap
+	var more bool
+	var ties []scanItem
+	c.rlock()
+	now := c.now()
+	for k, v := range c.objs {
+		if isExpired(now, v) {
+			continue
+		}
+		hash := hashKey(k)
+		if hash < cursor {
+			continue
+		}
+		if len(h) >= count && hash > h[0].hash {
+			more = true
+			continue
+		}
+		heap.Push(&h, scanItem{hash: hash, key: k})
+		if len(h) <= count {
+			continue
+		}
+		// Drop the keys with the largest hash, unless fewer than 'count'
+		// keys would remain.
+		ties = ties[:0]
+		for top := h[0].hash; len(h) > 0 && h[0].hash == top; {
+			ties = append(ties, heap.Pop(&h).(scanItem))
+		}
+		if len(h) >= count {
+			more = true
+			continue
+		}
+		for _, it := range ties {
+			heap.Push(&h, it)
+		}
+	}
+	c.runlock()
+
+	sort.Slice(h, func(i, j int) bool {
+		return h[i].hash < h[j].hash
+	})
+	if more {
+		next = h[len(h)-1].hash + 1
+	}
+	keys = make([]string, len(h))
+	for i := range keys {
+		keys[i] = h[i].key
+	}
+	return keys, next
+}
+
+// scanItem is a key and its hash, collected by Scan.
+type scanItem struct {
+	hash uint64
+	key  string
+}
+
+// scanHeap is a max-heap of scanItems ordered by hash.
+type scanHeap []scanItem
+
+func (h scanHeap) Len() int           { return len(h) }
+func (h scanHeap) Less(i, j int) bool { return h[i].hash > h[j].hash }
+func (h scanHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *scanHeap) Push(x interface{}) {
+	*h = append(*h, x.(scanItem))
+}
+
+func (h *scanHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
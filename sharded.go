@@ -0,0 +1,214 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+	"sync"
+	"time"
+)
+
+// ShardedCache spreads its keys across a number of independent Caches, each
+// with its own lock, reducing contention between concurrent callers. See
+// NewSharded.
+type ShardedCache struct {
+	shards []*Cache
+}
+
+// NewSharded returns an initialized ShardedCache with 'shards' shards, each
+// created using any provided option. Keys are assigned to shards by their FNV
+// hash.
+// Note: options apply to each shard individually, so limits such as
+// WithMaxSize bound the number of values per shard rather than in total. The
+// exceptions are WithPersistence, which saves all shards to a single snapshot
+// file, WithMetrics, whose recorder is given the total number of entries
+// across all shards, and WithLargeEntryReporter, which reports the largest
+// entries across all shards (sampling each shard).
+func NewSharded(shards int, ops ...Option) *ShardedCache {
+	if shards <= 0 {
+		shards = 1
+	}
+	op := defaultOptions
+	for _, option := range ops {
+		option.modify(&op)
+	}
+	// The shards are persisted and reported on together rather than
+	// individually, and appending must not modify the caller's slice.
+	ops = append(ops[:len(ops):len(ops)], WithPersistence("", 0), WithLargeEntryReporter(0, 0, nil))
+
+	s := &ShardedCache{shards: make([]*Cache, shards)}
+	var metrics *shardedMetrics
+	if op.metrics != nil {
+		metrics = &shardedMetrics{MetricsRecorder: op.metrics, sizes: make([]int, shards)}
+	}
+	for i := range s.shards {
+		shardOps := ops
+		if metrics != nil {
+			shardOps = append(ops[:len(ops):len(ops)], WithMetrics(shardMetrics{metrics, i}))
+		}
+		s.shards[i] = New(shardOps...)
+	}
+	// The first shard's goroutines and logger stand in for the
+	// ShardedCache's; it is closed along with the other shards.
+	c := s.shards[0]
+	if op.largeEntryFn != nil && op.largeEntryTopN > 0 && op.largeEntryInterval > 0 {
+		go c.largeEntryReporter(op.largeEntryTopN, op.largeEntryInterval, s.largestEntries, op.largeEntryFn)
+	}
+	if op.persistPath != "" {
+		if err := loadFile(op.persistPath, s.load); err != nil {
+			c.logger.Printf("cache: loading snapshot from %s: %v", op.persistPath, err)
+		}
+		if op.persistInterval > 0 {
+			go c.persister(op.persistPath, op.persistInterval, s.snapshot)
+		}
+	}
+	return s
+}
+
+// Close shuts down all shards, emptying them and preventing new values from
+// being set. ErrAlreadyClosed is returned if the cache was already closed.
+func (s *ShardedCache) Close() error {
+	var err error
+	for _, c := range s.shards {
+		if e := c.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Delete removes the value represented by the provided key, returning true if
+// an unexpired value was removed.
+func (s *ShardedCache) Delete(key string) bool {
+	return s.shard(key).Delete(key)
+}
+
+// Get returns a value from the cache represented by the provided key.
+func (s *ShardedCache) Get(key string) interface{} {
+	return s.shard(key).Get(key)
+}
+
+// GetOK returns a value from the cache represented by the provided key, and
+// true if it exists.
+func (s *ShardedCache) GetOK(key string) (interface{}, bool) {
+	return s.shard(key).GetOK(key)
+}
+
+// Len returns the current number of values across all shards.
+func (s *ShardedCache) Len() int {
+	var n int
+	for _, c := range s.shards {
+		n += c.Len()
+	}
+	return n
+}
+
+// Set sets the provided key and value without an expiry.
+func (s *ShardedCache) Set(key string, val interface{}) {
+	s.shard(key).Set(key, val)
+}
+
+// SetEx sets the provided key and value, using 'exp' as the expiry duration.
+func (s *ShardedCache) SetEx(key string, val interface{}, exp time.Duration) {
+	s.shard(key).SetEx(key, val, exp)
+}
+
+// TTL returns the "time-to-live" of the value represented by 'key'. See
+// Cache.TTL.
+func (s *ShardedCache) TTL(key string) time.Duration {
+	return s.shard(key).TTL(key)
+}
+
+// snapshot writes all unexpired entries in all shards to 'w' in the format
+// read by Cache.Load. Each shard is locked in turn, so the snapshot isn't
+// atomic across shards.
+func (s *ShardedCache) snapshot(w io.Writer) error {
+	var entries []liveEntry
+	for _, c := range s.shards {
+		e, err := c.liveEntries()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e...)
+	}
+	return writeSnapshot(w, s.shards[0].codec, entries)
+}
+
+// load reads entries written by snapshot or Cache.Snapshot from 'r', setting
+// each in the shard for its key.
+func (s *ShardedCache) load(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		if err := s.shard(e.Key).loadEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// largestEntries returns up to 'n' of the largest of a sample of entries from
+// each shard, ordered from largest to smallest.
+func (s *ShardedCache) largestEntries(n int) []SizedKey {
+	var sizes []SizedKey
+	for _, c := range s.shards {
+		sizes = append(sizes, c.largestEntries(n)...)
+	}
+	return largestSizes(sizes, n)
+}
+
+func (s *ShardedCache) shard(key string) *Cache {
+	return s.shards[hashKey(key)%uint64(len(s.shards))]
+}
+
+// shardedMetrics is a MetricsRecorder shared by all shards of a ShardedCache,
+// reporting the total number of entries across all shards.
+type shardedMetrics struct {
+	MetricsRecorder
+
+	mu    sync.Mutex
+	sizes []int
+	total int
+}
+
+// shardMetrics is the MetricsRecorder of a single shard.
+type shardMetrics struct {
+	*shardedMetrics
+	shard int
+}
+
+func (m shardMetrics) SetSize(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total += n - m.sizes[m.shard]
+	m.sizes[m.shard] = n
+	m.MetricsRecorder.SetSize(m.total)
+}
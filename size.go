@@ -0,0 +1,159 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"sort"
+	"time"
+)
+
+// Sizer returns the estimated size of the provided value in bytes. See
+// WithValueSizer.
+type Sizer func(val interface{}) int64
+
+// defaultSizer returns the length of string and byte slice values, and zero
+// for values of all other types.
+func defaultSizer(val interface{}) int64 {
+	switch v := val.(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	}
+	return 0
+}
+
+// valueSize returns the estimated size of the provided data, or zero if the
+// cache isn't limited by size (see WithMaxBytes). Lazy values are sized once
+// computed.
+func (c *Cache) valueSize(data interface{}) int64 {
+	if c.maxBytes <= 0 {
+		return 0
+	}
+	if l, ok := data.(*lazyValue); ok {
+		if !l.computed() {
+			return 0
+		}
+		data = l.val
+	}
+	if data == nil {
+		return 0
+	}
+	var size int64
+	c.protect("sizer", func() { size = c.sizer(data) })
+	return size
+}
+
+// lockedResize updates the estimated size of the provided stored value after
+// its data has changed, returning the updated value.
+func (c *Cache) lockedResize(v value) value {
+	size := c.valueSize(v.data)
+	c.bytes += size - v.size
+	v.size = size
+	return v
+}
+
+// Bytes returns the estimated total size of the values in the cache, as
+// estimated by the configured Sizer (see WithValueSizer).
+// Note: sizes are only tracked if the WithMaxBytes option is used; otherwise,
+// zero is returned.
+func (c *Cache) Bytes() int64 {
+	c.rlock()
+	defer c.runlock()
+	return c.bytes
+}
+
+// SizedKey is a key and the estimated size of its value.
+type SizedKey struct {
+	Key  string
+	Size int64
+}
+
+// largeEntrySample is the maximum number of entries sampled by the large
+// entry reporter per interval.
+const largeEntrySample = 1024
+
+// largeEntryReporter periodically reports the 'topN' largest entries returned
+// by 'largest' until the cache is closed.
+func (c *Cache) largeEntryReporter(topN int, interval time.Duration, largest func(int) []SizedKey, fn func([]SizedKey)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		c.protect("large entry reporter", func() { fn(largest(topN)) })
+	}
+}
+
+// largestEntries returns up to 'n' of the largest of a sample of entries,
+// ordered from largest to smallest.
+func (c *Cache) largestEntries(n int) []SizedKey {
+	type entry struct {
+		key  string
+		data interface{}
+	}
+
+	c.lock()
+	now := c.now()
+	sample := make([]entry, 0, largeEntrySample)
+	for k, v := range c.objs {
+		if len(sample) >= largeEntrySample {
+			break
+		}
+		if !isExpired(now, v) {
+			sample = append(sample, entry{key: k, data: v.data})
+		}
+	}
+	c.unlock()
+
+	sizes := make([]SizedKey, 0, len(sample))
+	for _, e := range sample {
+		data := e.data
+		if l, ok := data.(*lazyValue); ok {
+			// Lazy values that haven't been read aren't computed here.
+			if !l.computed() {
+				continue
+			}
+			data = l.val
+		}
+		if data != nil {
+			sizes = append(sizes, SizedKey{Key: e.key, Size: c.sizer(data)})
+		}
+	}
+	return largestSizes(sizes, n)
+}
+
+// largestSizes returns up to 'n' of the largest of the provided sizes, ordered
+// from largest to smallest.
+func largestSizes(sizes []SizedKey, n int) []SizedKey {
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].Size > sizes[j].Size
+	})
+	if len(sizes) > n {
+		sizes = sizes[:n]
+	}
+	return sizes
+}
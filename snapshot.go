@@ -0,0 +1,333 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Codec marshals and unmarshals values when a cache is written to or read from
+// a snapshot.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// GobCodec is a Codec that uses encoding/gob. It is the default Codec used by a
+// Cache. Concrete types of values must be registered using gob.Register.
+type GobCodec struct{}
+
+// Marshal encodes the provided value using gob.
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a value encoded by Marshal.
+func (GobCodec) Unmarshal(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// snapshotEntry is the representation of a single entry in a snapshot.
+type snapshotEntry struct {
+	Key      string
+	Cost     int64
+	ExpireAt time.Time
+	StaleAt  time.Time
+	Value    []byte
+}
+
+// Snapshot writes all unexpired entries in the cache to 'w', using the
+// configured Codec for values (see WithCodec). The cache is only locked while
+// the entries are collected, not while they are encoded and written.
+func (c *Cache) Snapshot(w io.Writer) error {
+	entries, err := c.liveEntries()
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(w, c.codec, entries)
+}
+
+// writeSnapshot writes the provided entries to 'w' in the format read by Load,
+// using 'codec' for values.
+func writeSnapshot(w io.Writer, codec Codec, entries []liveEntry) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(len(entries)); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		data, err := codec.Marshal(e.v.data)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(snapshotEntry{
+			Key:      e.key,
+			Cost:     e.v.cost,
+			ExpireAt: e.v.expireAt,
+			StaleAt:  e.v.staleAt,
+			Value:    data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveEntry is an unexpired entry collected by liveEntries.
+type liveEntry struct {
+	key string
+	v   value
+}
+
+// liveEntries returns all unexpired entries in the cache, with any lazy values
+// computed. The cache is only locked while the entries are collected.
+func (c *Cache) liveEntries() ([]liveEntry, error) {
+	c.lock()
+	if c.closed {
+		c.unlock()
+		return nil, ErrAlreadyClosed
+	}
+	now := c.now()
+	entries := make([]liveEntry, 0, len(c.objs))
+	for k, v := range c.objs {
+		if !isExpired(now, v) {
+			entries = append(entries, liveEntry{key: k, v: v})
+		}
+	}
+	c.unlock()
+
+	// Compute any lazy values, dropping those that resolve to nil.
+	n := 0
+	for _, e := range entries {
+		if e.v.data = resolve(e.v.data); e.v.data != nil {
+			entries[n] = e
+			n++
+		}
+	}
+	return entries[:n], nil
+}
+
+// Load reads entries written by Snapshot from 'r', setting any that have not
+// yet expired in the cache.
+func (c *Cache) Load(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return err
+	}
+	return c.load(dec, n)
+}
+
+// WriteTo writes a snapshot of the cache to 'w' (see Snapshot), returning the
+// number of bytes written. It implements io.WriterTo.
+func (c *Cache) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := c.Snapshot(cw)
+	return cw.n, err
+}
+
+// ReadFrom reads a snapshot written by Snapshot or WriteTo from 'r' (see Load),
+// returning the number of bytes read. It implements io.ReaderFrom.
+func (c *Cache) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	err := c.Load(cr)
+	return cr.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// maxSnapshotSizeHint is the largest number of entries that NewFromSnapshot
+// sizes a cache for, as the count read from a snapshot may not be trusted.
+const maxSnapshotSizeHint = 1 << 20
+
+// NewFromSnapshot returns an initialized cache using any provided option,
+// populated with the unexpired entries written by Snapshot to 'r'. Unless a
+// larger starting size is provided (see WithStartingSize), the cache is sized
+// to hold the number of entries in the snapshot, up to 1048576.
+func NewFromSnapshot(r io.Reader, ops ...Option) (*Cache, error) {
+	dec := gob.NewDecoder(r)
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return nil, err
+	}
+	op := defaultOptions
+	for _, option := range ops {
+		option.modify(&op)
+	}
+	hint := n
+	if hint > maxSnapshotSizeHint {
+		hint = maxSnapshotSizeHint
+	}
+	if hint > op.startingSize {
+		// Appending must not modify the caller's slice.
+		ops = append(ops[:len(ops):len(ops)], WithStartingSize(hint))
+	}
+	c := New(ops...)
+	if err := c.load(dec, n); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads 'n' entries from 'dec', setting any that have not yet expired in
+// the cache.
+func (c *Cache) load(dec *gob.Decoder, n int) error {
+	for i := 0; i < n; i++ {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		if err := c.loadEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEntry sets the entry read from a snapshot in the cache, unless it has
+// expired.
+func (c *Cache) loadEntry(e snapshotEntry) error {
+	val, err := c.codec.Unmarshal(e.Value)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return nil
+	}
+
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return ErrAlreadyClosed
+	}
+	now := c.now()
+	v := value{cost: e.Cost, expireAt: e.ExpireAt, staleAt: e.StaleAt, data: val}
+	if !isExpired(now, v) {
+		c.lockedSet(now, e.Key, v)
+	}
+	return nil
+}
+
+// jsonEntry is the JSON representation of a single entry in the cache.
+type jsonEntry struct {
+	Key      string      `json:"key"`
+	Cost     int64       `json:"cost,omitempty"`
+	ExpireAt *time.Time  `json:"expire_at,omitempty"`
+	StaleAt  *time.Time  `json:"stale_at,omitempty"`
+	Value    interface{} `json:"value"`
+}
+
+// MarshalJSON encodes all unexpired entries in the cache as a JSON array of
+// objects holding each key, its absolute expiry time (if any), its cost (if
+// not the default, see SetExCost), and its value.
+// Values are encoded using encoding/json, regardless of the configured Codec.
+func (c *Cache) MarshalJSON() ([]byte, error) {
+	entries, err := c.liveEntries()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]jsonEntry, len(entries))
+	for i, e := range entries {
+		out[i] = jsonEntry{Key: e.key, Value: e.v.data}
+		if e.v.cost != defaultCost {
+			out[i].Cost = e.v.cost
+		}
+		if !e.v.expireAt.IsZero() {
+			expireAt := e.v.expireAt.Round(0)
+			out[i].ExpireAt = &expireAt
+		}
+		if !e.v.staleAt.IsZero() {
+			staleAt := e.v.staleAt.Round(0)
+			out[i].StaleAt = &staleAt
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON sets the entries encoded by MarshalJSON that have not yet
+// expired in the cache, which must have been created using New.
+// Note: values are decoded into the generic types used by encoding/json (e.g.
+// float64 for numbers, and map[string]interface{} for objects), so values
+// should be limited to types that round-trip through JSON.
+func (c *Cache) UnmarshalJSON(data []byte) error {
+	var entries []jsonEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return ErrAlreadyClosed
+	}
+	now := c.now()
+	for _, e := range entries {
+		if e.Value == nil {
+			continue
+		}
+		v := value{cost: e.Cost, data: e.Value}
+		if e.ExpireAt != nil {
+			v.expireAt = *e.ExpireAt
+		}
+		if e.StaleAt != nil {
+			v.staleAt = *e.StaleAt
+		}
+		if !isExpired(now, v) {
+			c.lockedSet(now, e.Key, v)
+		}
+	}
+	return nil
+}
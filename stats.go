@@ -0,0 +1,137 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats represents a point-in-time view of the counters tracked by a Cache.
+// Counters accumulate from the time the cache was created.
+type Stats struct {
+	// Hits is the number of reads that found an unexpired value.
+	Hits uint64
+	// Misses is the number of reads that found no unexpired value.
+	Misses uint64
+	// Evictions is the number of values evicted to make room for new values
+	// (see WithMaxSize).
+	Evictions uint64
+	// Expirations is the number of expired values removed from the cache.
+	Expirations uint64
+
+	// RejectedNil is the number of writes rejected due to a nil value.
+	RejectedNil uint64
+	// RejectedTTL is the number of writes rejected due to a non-positive
+	// expiry duration.
+	RejectedTTL uint64
+	// RejectedClosed is the number of writes rejected due to the cache being
+	// closed.
+	RejectedClosed uint64
+	// RejectedCardinality is the number of writes rejected due to the limit on
+	// distinct keys (see WithMaxCardinality).
+	RejectedCardinality uint64
+	// RejectedSize is the number of writes rejected due to the value being
+	// larger than the limit on the total size of values (see WithMaxBytes).
+	RejectedSize uint64
+	// RejectedCost is the number of writes rejected due to the value's cost
+	// being larger than the limit on the total cost of values (see
+	// WithMaxCost).
+	RejectedCost uint64
+
+	// PeakSize is the largest number of values the cache has held since it
+	// was created, or since ResetPeakSize was last called.
+	PeakSize uint64
+
+	// CleanInterval is the interval until the next 'clean' operation, as most
+	// recently determined by the cleaner (see WithCleanerCPUBudget).
+	CleanInterval time.Duration
+
+	// Len is the number of values in the cache, including any that have
+	// expired but not yet been removed.
+	Len int
+}
+
+// RejectedWrites returns the total number of writes that were rejected.
+func (s Stats) RejectedWrites() uint64 {
+	return s.RejectedNil + s.RejectedTTL + s.RejectedClosed + s.RejectedCardinality +
+		s.RejectedSize + s.RejectedCost
+}
+
+// stats holds the counters for a Cache. All fields must be accessed
+// atomically.
+type stats struct {
+	hits                uint64
+	misses              uint64
+	evictions           uint64
+	expirations         uint64
+	rejectedNil         uint64
+	rejectedTTL         uint64
+	rejectedClosed      uint64
+	rejectedCardinality uint64
+	rejectedSize        uint64
+	rejectedCost        uint64
+	cleanInterval       int64
+	peakSize            uint64
+}
+
+// Stats returns the current counters of the cache.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:                atomic.LoadUint64(&c.stats.hits),
+		Misses:              atomic.LoadUint64(&c.stats.misses),
+		Evictions:           atomic.LoadUint64(&c.stats.evictions),
+		Expirations:         atomic.LoadUint64(&c.stats.expirations),
+		RejectedNil:         atomic.LoadUint64(&c.stats.rejectedNil),
+		RejectedTTL:         atomic.LoadUint64(&c.stats.rejectedTTL),
+		RejectedClosed:      atomic.LoadUint64(&c.stats.rejectedClosed),
+		RejectedCardinality: atomic.LoadUint64(&c.stats.rejectedCardinality),
+		RejectedSize:        atomic.LoadUint64(&c.stats.rejectedSize),
+		RejectedCost:        atomic.LoadUint64(&c.stats.rejectedCost),
+		PeakSize:            atomic.LoadUint64(&c.stats.peakSize),
+		CleanInterval:       time.Duration(atomic.LoadInt64(&c.stats.cleanInterval)),
+		Len:                 c.Len(),
+	}
+}
+
+// ResetPeakSize resets the peak size reported by Stats to the current number
+// of values in the cache.
+func (c *Cache) ResetPeakSize() {
+	c.lock()
+	defer c.unlock()
+	atomic.StoreUint64(&c.stats.peakSize, uint64(len(c.objs)))
+}
+
+// CleanStats describes a single 'clean' operation run by the cleaner. See
+// WithCleanCycleHandler.
+type CleanStats struct {
+	// Duration is the time taken by the operation, including any time spent
+	// waiting to re-acquire the cache's lock between batches.
+	Duration time.Duration
+	// Scanned is the number of entries checked for expiry.
+	Scanned int
+	// Removed is the number of expired entries removed.
+	Removed int
+	// Batches is the number of batches the operation was split into.
+	Batches int
+}
@@ -0,0 +1,77 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import "time"
+
+// Txn provides operations on a cache that are applied atomically. See
+// Cache.Txn.
+type Txn struct {
+	c   *Cache
+	now time.Time
+}
+
+// Txn calls 'fn' with the cache locked, so that all operations performed using
+// the provided Txn appear atomic to other users of the cache.
+// Note: 'fn' blocks all other operations on the cache while it runs, so it
+// must be fast. It must not call any methods on the cache directly, and must
+// not use the Txn after returning.
+func (c *Cache) Txn(fn func(tx *Txn)) {
+	c.lock()
+	defer c.unlock()
+	fn(&Txn{c: c, now: c.now()})
+}
+
+// Get returns a value from the cache represented by the provided key.
+func (tx *Txn) Get(key string) interface{} {
+	v, ok := tx.c.lockedRead(tx.now, key)
+	if !ok {
+		return nil
+	}
+	return tx.c.output(resolve(v.data))
+}
+
+// Set sets the provided key and value without an expiry.
+func (tx *Txn) Set(key string, val interface{}) {
+	if tx.c.acceptValue(val) && tx.c.lockedAcceptWrite() {
+		tx.c.lockedSet(tx.now, key, value{data: val})
+	}
+}
+
+// SetEx sets the provided key and value, using 'exp' as the expiry duration.
+func (tx *Txn) SetEx(key string, val interface{}, exp time.Duration) {
+	if tx.c.acceptWrite(val, exp) && tx.c.lockedAcceptWrite() {
+		tx.c.lockedSet(tx.now, key, value{expireAt: tx.now.Add(exp), data: val})
+	}
+}
+
+// Delete removes the value represented by the provided key, returning true if
+// an unexpired value was removed.
+func (tx *Txn) Delete(key string) bool {
+	tx.c.lockedCancelPending(key)
+	v, ok := tx.c.lockedGet(tx.now, key)
+	if ok {
+		tx.c.lockedRemove(key, v, Deleted)
+	}
+	return ok
+}
@@ -0,0 +1,116 @@
+//go:build go1.18
+
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// TypedCache is a Cache whose keys are of type K and values of type V,
+// avoiding the need for type assertions on values read from the cache.
+//
+// Keys are stored in an underlying Cache as strings. If K is string, keys are
+// stored as-is; pointer keys are formatted with their type and address, so
+// they are compared by identity as in a map (although, as the cache doesn't
+// keep what they point to alive, a collected pointer's address may be reused
+// by a new key). Otherwise, keys are formatted with their type using the fmt
+// package, so two keys are only considered equal if they format identically.
+// Unlike in a map, floating point zero and negative zero are distinct keys,
+// while all NaN keys are the same key.
+type TypedCache[K comparable, V any] struct {
+	c          *Cache
+	stringKeys bool
+}
+
+// NewTyped returns an initialized TypedCache using any provided option.
+func NewTyped[K comparable, V any](ops ...Option) *TypedCache[K, V] {
+	var zero K
+	_, ok := any(zero).(string)
+	return &TypedCache[K, V]{c: New(ops...), stringKeys: ok}
+}
+
+// Cache returns the underlying Cache.
+func (t *TypedCache[K, V]) Cache() *Cache {
+	return t.c
+}
+
+// Close shuts down the cache, emptying it and preventing new values from being
+// set.
+func (t *TypedCache[K, V]) Close() error {
+	return t.c.Close()
+}
+
+// Delete removes the value represented by the provided key, returning true if
+// an unexpired value was removed.
+func (t *TypedCache[K, V]) Delete(key K) bool {
+	return t.c.Delete(t.key(key))
+}
+
+// Get returns a value from the cache represented by the provided key, and true
+// if it exists.
+func (t *TypedCache[K, V]) Get(key K) (V, bool) {
+	v, ok := t.c.GetOK(t.key(key))
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	val, ok := v.(V)
+	return val, ok
+}
+
+// Len returns the current number of values in the cache.
+func (t *TypedCache[K, V]) Len() int {
+	return t.c.Len()
+}
+
+// Set sets the provided key and value without an expiry.
+func (t *TypedCache[K, V]) Set(key K, val V) {
+	t.c.Set(t.key(key), val)
+}
+
+// SetEx sets the provided key and value, using 'exp' as the expiry duration.
+func (t *TypedCache[K, V]) SetEx(key K, val V, exp time.Duration) {
+	t.c.SetEx(t.key(key), val, exp)
+}
+
+// TTL returns the "time-to-live" of the value represented by 'key'. See
+// Cache.TTL.
+func (t *TypedCache[K, V]) TTL(key K) time.Duration {
+	return t.c.TTL(t.key(key))
+}
+
+func (t *TypedCache[K, V]) key(key K) string {
+	if t.stringKeys {
+		return any(key).(string)
+	}
+	// The fmt package formats the value a pointer points to, rather than
+	// the pointer itself.
+	if v := reflect.ValueOf(key); v.Kind() == reflect.Ptr {
+		return fmt.Sprintf("%T:%#x", key, v.Pointer())
+	}
+	return fmt.Sprintf("%T:%#v", key, key)
+}
@@ -0,0 +1,91 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import "time"
+
+// VetoFunc is called with an expired entry before it is removed by the cleaner,
+// returning whether the entry should be kept, and the duration it should be
+// kept for. See WithExpiryVeto.
+type VetoFunc func(key string, val interface{}) (keep bool, newTTL time.Duration)
+
+// lockedExpireEntry removes the expired entry for 'key', or defers its removal
+// until the veto function has been consulted. It returns false if the entry
+// was already awaiting the veto function.
+func (c *Cache) lockedExpireEntry(key string, v value) bool {
+	if c.veto == nil {
+		c.lockedRemove(key, v, Expired)
+		return true
+	}
+	if _, ok := c.vetoPending[key]; ok {
+		return false
+	}
+	if c.vetoPending == nil {
+		c.vetoPending = make(map[string]value)
+	}
+	c.vetoPending[key] = v
+	return true
+}
+
+// lockedResolveVetoes consults the veto function for all entries awaiting it,
+// removing or extending each. The cache is unlocked while the veto function is
+// called.
+func (c *Cache) lockedResolveVetoes() {
+	if len(c.vetoPending) == 0 {
+		return
+	}
+	pending := c.vetoPending
+	c.vetoPending = nil
+	c.unlock()
+
+	extend := make(map[string]time.Duration, len(pending))
+	for k, v := range pending {
+		var keep bool
+		var ttl time.Duration
+		c.protect("expiry veto", func() { keep, ttl = c.veto(k, resolve(v.data)) })
+		if keep && ttl > 0 {
+			extend[k] = ttl
+		}
+	}
+
+	c.relock()
+	if c.closed {
+		return
+	}
+	now := c.now()
+	for k, v := range pending {
+		// Skip entries that were removed or replaced in the meantime.
+		cur, ok := c.objs[k]
+		if !ok || !cur.expireAt.Equal(v.expireAt) {
+			continue
+		}
+		if ttl, ok := extend[k]; ok {
+			cur = c.withExpiry(now, cur, now.Add(ttl))
+			c.lockedPut(k, cur)
+			c.expirer.onSet(k, cur)
+			c.cycle.Removed--
+		} else {
+			c.lockedRemove(k, cur, Expired)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// MIT License
+//
+// Copyright (c) 2017 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"strings"
+	"time"
+)
+
+// View is a view of a Cache that transparently prefixes all keys with a fixed
+// prefix, isolating it from keys set through views with other prefixes.
+type View struct {
+	c      *Cache
+	prefix string
+}
+
+// Sub returns a View of the cache that prefixes all keys with 'prefix'.
+// Note: a default loader (see WithDefaultLoader) is called with the prefixed
+// key.
+func (c *Cache) Sub(prefix string) *View {
+	return &View{c: c, prefix: prefix}
+}
+
+// Sub returns a View of the underlying cache that prefixes all keys with the
+// view's prefix followed by 'prefix'.
+func (v *View) Sub(prefix string) *View {
+	return &View{c: v.c, prefix: v.prefix + prefix}
+}
+
+// Delete removes the value represented by the provided key in the view,
+// returning true if an unexpired value was removed.
+func (v *View) Delete(key string) bool {
+	return v.c.Delete(v.prefix + key)
+}
+
+// DeleteIfTTLBelow removes the value represented by 'key' in the view only if
+// its remaining "time-to-live" is less than 'threshold'. See
+// Cache.DeleteIfTTLBelow.
+func (v *View) DeleteIfTTLBelow(key string, threshold time.Duration) bool {
+	return v.c.DeleteIfTTLBelow(v.prefix+key, threshold)
+}
+
+// DeletePrefix removes every unexpired value in the view whose key starts with
+// 'prefix', returning the number of values removed. See Cache.DeletePrefix.
+func (v *View) DeletePrefix(prefix string) int {
+	return v.c.DeletePrefix(v.prefix + prefix)
+}
+
+// Get returns a value from the view represented by the provided key.
+func (v *View) Get(key string) interface{} {
+	return v.c.Get(v.prefix + key)
+}
+
+// GetErr returns a value from the view represented by the provided key. See
+// Cache.GetErr.
+func (v *View) GetErr(key string) (interface{}, error) {
+	return v.c.GetErr(v.prefix + key)
+}
+
+// GetStale returns a value from the view represented by the provided key, and
+// whether the value is stale. See Cache.GetStale.
+func (v *View) GetStale(key string) (interface{}, bool) {
+	return v.c.GetStale(v.prefix + key)
+}
+
+// GetOK returns a value from the view represented by the provided key, and
+// true if it exists. See Cache.GetOK.
+func (v *View) GetOK(key string) (interface{}, bool) {
+	return v.c.GetOK(v.prefix + key)
+}
+
+// GetOrComputeSync returns the value represented by the provided key,
+// computing and setting it if it doesn't exist. See Cache.GetOrComputeSync.
+func (v *View) GetOrComputeSync(key string, exp time.Duration, fn func() interface{}) interface{} {
+	return v.c.GetOrComputeSync(v.prefix+key, exp, fn)
+}
+
+// GetOrInit returns the value represented by the provided key, computing and
+// setting it if it doesn't exist. See Cache.GetOrInit.
+func (v *View) GetOrInit(key string, exp time.Duration, init func() interface{}) (interface{}, bool) {
+	return v.c.GetOrInit(v.prefix+key, exp, init)
+}
+
+// Keys returns the unexpired keys in the view, with the view's prefix removed.
+func (v *View) Keys() []string {
+	v.c.lock()
+	defer v.c.unlock()
+	now := v.c.now()
+	var keys []string
+	for k, val := range v.c.objs {
+		if strings.HasPrefix(k, v.prefix) && !isExpired(now, val) {
+			keys = append(keys, k[len(v.prefix):])
+		}
+	}
+	return keys
+}
+
+// Set sets the provided key and value in the view without an expiry.
+func (v *View) Set(key string, val interface{}) {
+	v.c.Set(v.prefix+key, val)
+}
+
+// SetEx sets the provided key and value in the view, using 'exp' as the expiry
+// duration.
+func (v *View) SetEx(key string, val interface{}, exp time.Duration) {
+	v.c.SetEx(v.prefix+key, val, exp)
+}
+
+// SetExLazy sets the provided key in the view to the result of calling
+// 'thunk' when first read. See Cache.SetExLazy.
+func (v *View) SetExLazy(key string, thunk func() interface{}, exp time.Duration) {
+	v.c.SetExLazy(v.prefix+key, thunk, exp)
+}
+
+// SetExSoftHard sets the provided key and value in the view with both a soft
+// and hard expiry duration. See Cache.SetExSoftHard.
+func (v *View) SetExSoftHard(key string, val interface{}, soft, hard time.Duration) {
+	v.c.SetExSoftHard(v.prefix+key, val, soft, hard)
+}
+
+// SetIfNewer sets the provided key and value in the view only if no value
+// exists or 'less' reports the existing value as older. See Cache.SetIfNewer.
+func (v *View) SetIfNewer(key string, val interface{}, exp time.Duration, less func(existing, incoming interface{}) bool) bool {
+	return v.c.SetIfNewer(v.prefix+key, val, exp, less)
+}
+
+// Swap atomically exchanges the values represented by 'keyA' and 'keyB' in the
+// view. See Cache.Swap.
+func (v *View) Swap(keyA, keyB string) {
+	v.c.Swap(v.prefix+keyA, v.prefix+keyB)
+}
+
+// TTL returns the "time-to-live" of the value represented by 'key' in the
+// view. If nothing exists with the provided key, -1 is returned.
+func (v *View) TTL(key string) time.Duration {
+	return v.c.TTL(v.prefix + key)
+}